@@ -0,0 +1,58 @@
+package boorumux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// autocompleteTimeout is how long a booru has to suggest tags.
+// Suggestions are useless if they come after the user is done typing.
+const autocompleteTimeout = 5 * time.Second
+
+// autocompleteHandler suggests tags starting with the "q" parameter, as JSON.
+// For muxes, the suggestions of every booru are merged together.
+func (s *Server) autocompleteHandler(w http.ResponseWriter, r *http.Request, targetBooru string) {
+	b, err := s.findBooru(r, targetBooru)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	t, ok := b.(booru.Tagger)
+	if !ok || !booru.CapabilitiesOf(b).Has(booru.CapAutocomplete) {
+		http.Error(w, "booru can't autocomplete tags", http.StatusNotFound)
+		return
+	}
+
+	tags := []booru.Tag{}
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), autocompleteTimeout)
+		defer cancel()
+
+		found, err := t.Tags(ctx, strings.ToLower(q))
+		if err != nil {
+			if errors.Is(r.Context().Err(), context.Canceled) {
+				return
+			}
+
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		tags = append(tags, found...)
+	}
+
+	if len(tags) > booru.TagLimit {
+		tags = tags[:booru.TagLimit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(tags)
+}
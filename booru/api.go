@@ -36,7 +36,8 @@ type API interface {
 	// used, there may be less than an expected amount.
 	//
 	// The integer returned by this function should be the number of remaining
-	// pages, however in the case where it is unknown -1 will be used.
+	// pages including this one, however in the case where it is unknown -1
+	// will be used.
 	Page(ctx context.Context, q Query, page int) ([]Post, int, error)
 
 	// Post returns a specific post referenced by its numeric ID.
@@ -47,6 +48,21 @@ type API interface {
 	HTTP() *http.Client
 }
 
+// Named is implemented by APIs that know the name they were configured with.
+type Named interface {
+	Name() string
+}
+
+// Pager is implemented by APIs that only let page numbers go so far into the
+// results.
+// Anything past that can only be reached using cursors.
+type Pager interface {
+	// MaxPage returns the highest page that can be asked for, counting from
+	// 0, with limit posts on each page.
+	// A limit of 0 means the booru's default.
+	MaxPage(limit int) int
+}
+
 // Query is a list of options passed to a booru API that are used as a query to
 // fetch results.
 type Query struct {
@@ -54,6 +70,32 @@ type Query struct {
 	// They can be also used in the opposite way to exclude topics by being
 	// preceeded with a "-".
 	Tags []string
+
+	// Limit is the maximum number of posts on a page.
+	// If zero, the booru's default is used.
+	Limit int
+
+	// Order is the order posts are returned in, and is one of the keys
+	// understood by TermOrder.
+	// Posts are sorted in descending order unless "_asc" is appended.
+	// If empty, the booru's default is used, which is normally newest first.
+	Order string
+
+	// Ratings limits results to posts with any of these ratings.
+	Ratings []Rating
+
+	// MinScore, if not nil, is the lowest score a post may have.
+	MinScore *int
+
+	// Before and After limit results to posts created before or after the
+	// given times.
+	// Either may be zero, in which case there is no limit.
+	Before, After time.Time
+
+	// BeforeID and AfterID limit results to posts with an ID lower or higher
+	// than the given ID, and are used as cursors to page through results.
+	// Either may be zero, in which case there is no limit.
+	BeforeID, AfterID int
 }
 
 // Image contains enough data to uniquely identify this image and to download it.
@@ -97,12 +139,23 @@ type Post struct {
 	// Tags is a list of tags associated with this specific post.
 	Tags []string
 
+	// Categories holds the category of each tag, if the booru tells us.
+	// Tags which aren't in it are general tags.
+	Categories map[string]TagCategory
+
 	// Original is the original or highest quality picture for this post.
 	Original Image
 
-	// Thumbnail is a thumbnail for this post.
-	// This is normally the "large" but not "original" size of an image.
-	Thumbnail Image
+	// Sample is a smaller version of the original, suitable for viewing.
+	// It may be the same as Original if the original is small enough.
+	Sample Image
+
+	// Preview is a small thumbnail, as shown in search results.
+	Preview Image
+
+	// Variants lists every version of this image the booru offers, from
+	// smallest to largest, including the ones above.
+	Variants []Image
 
 	// Hash is often the MD5 of the original image.
 	Hash string
@@ -178,12 +231,63 @@ func newHTTPError(req *http.Response) HTTPError {
 	}
 }
 
+// variants builds the list of variants of an image from the versions given,
+// which should be ordered from smallest to largest.
+// Missing and repeated versions are left out.
+func variants(imgs ...Image) []Image {
+	out := make([]Image, 0, len(imgs))
+	for _, v := range imgs {
+		if v.Href == "" {
+			continue
+		}
+
+		dup := false
+		for _, o := range out {
+			if o.Href == v.Href {
+				dup = true
+				break
+			}
+		}
+
+		if !dup {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+// NameOf returns the name that b was configured with, or an empty string if
+// it is unknown.
+func NameOf(b API) string {
+	if n, ok := b.(Named); ok {
+		return n.Name()
+	}
+	return ""
+}
+
+// MaxPageOf returns the highest page that can be asked for from b with limit
+// posts on each page, or -1 if there is no limit.
+func MaxPageOf(b API, limit int) int {
+	if p, ok := b.(Pager); ok {
+		return p.MaxPage(limit)
+	}
+	return -1
+}
+
 // New creates a new API instance from provided configuration.
+//
+// The "name" key, if present, is the name the booru is referred to as;
+// otherwise t is used.
 func New(t string, cfg map[string]interface{}) (API, error) {
 	f, ok := registered[t]
 	if !ok {
 		return nil, fmt.Errorf("booru \"%s\" not found", t)
 	}
 
+	if _, ok := cfg["name"].(string); !ok {
+		cfg["name"] = t
+	}
+
 	return f(cfg)
 }
@@ -0,0 +1,88 @@
+package booru
+
+import (
+	"strings"
+)
+
+// Capability is a set of features that a booru supports.
+type Capability uint
+
+const (
+	// CapTotal means the booru knows how many posts match a query, and
+	// therefore how many pages there are.
+	CapTotal Capability = 1 << iota
+
+	// CapCursor means the booru can page through results using
+	// Query.BeforeID and Query.AfterID.
+	CapCursor
+
+	// CapAutocomplete means the booru can suggest tags as they are typed.
+	CapAutocomplete
+
+	// CapPools means the booru can list pools.
+	CapPools
+
+	// CapComments means the booru can list the comments of a post.
+	CapComments
+
+	// CapNotes means the booru can list the translation notes of a post.
+	CapNotes
+
+	// CapAuth means the booru can log in to an account.
+	CapAuth
+
+	// CapTagCounts means the booru can look up how many posts have a tag.
+	CapTagCounts
+)
+
+// capabilityNames maps each capability to a short name, used when presenting
+// them.
+var capabilityNames = []struct {
+	c Capability
+	n string
+}{
+	{CapTotal, "total"},
+	{CapCursor, "cursor"},
+	{CapAutocomplete, "autocomplete"},
+	{CapPools, "pools"},
+	{CapComments, "comments"},
+	{CapNotes, "notes"},
+	{CapAuth, "auth"},
+	{CapTagCounts, "tagcounts"},
+}
+
+// Capable is implemented by APIs that can report which features they support.
+// Only features that are actually implemented by the API should be reported,
+// not everything the booru itself can do.
+type Capable interface {
+	Capabilities() Capability
+}
+
+// Has reports whether every capability in o is also in c.
+func (c Capability) Has(o Capability) bool {
+	return c&o == o
+}
+
+// Names returns the short names of every capability in c.
+func (c Capability) Names() []string {
+	var ss []string
+	for _, v := range capabilityNames {
+		if c.Has(v.c) {
+			ss = append(ss, v.n)
+		}
+	}
+	return ss
+}
+
+func (c Capability) String() string {
+	return strings.Join(c.Names(), " ")
+}
+
+// CapabilitiesOf returns the capabilities of b.
+// APIs that don't implement Capable are assumed to support nothing.
+func CapabilitiesOf(b API) Capability {
+	if c, ok := b.(Capable); ok {
+		return c.Capabilities()
+	}
+	return 0
+}
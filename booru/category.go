@@ -0,0 +1,231 @@
+package booru
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// TagCategory is the kind of thing a tag describes.
+type TagCategory int
+
+const (
+	// CategoryGeneral is for tags describing what is in a post.
+	// Tags are in this category unless known otherwise.
+	CategoryGeneral TagCategory = iota
+
+	// CategoryArtist is for the people who made a post.
+	CategoryArtist
+
+	// CategoryCopyright is for the series or franchise a post is from.
+	CategoryCopyright
+
+	// CategoryCharacter is for the characters in a post.
+	CategoryCharacter
+
+	// CategoryMeta is for tags about the post itself, such as "highres".
+	CategoryMeta
+)
+
+const (
+	// maxCachedCategories is how many tags a categoryCache remembers before
+	// it starts over.
+	maxCachedCategories = 100000
+
+	// minCategoryBackoff and maxCategoryBackoff are how long to wait before
+	// looking up categories again after a lookup fails; the wait doubles
+	// with each failure in a row.
+	minCategoryBackoff = 30 * time.Second
+	maxCategoryBackoff = 30 * time.Minute
+)
+
+// Categorizer is implemented by APIs that don't give the categories of tags
+// with posts, and have to look them up separately.
+// Their posts only have the categories they already know, so anything that
+// depends on them should be sure to call Categorize first.
+type Categorizer interface {
+	// Categorize fills in the categories of the tags on posts, looking up
+	// the ones that aren't known yet.
+	// Posts are still given what is known if it fails.
+	Categorize(ctx context.Context, posts []Post) error
+}
+
+// categoryCache remembers the categories of tags, for boorus which don't tell
+// us with every post.
+// Categories practically never change, so they are kept until the cache fills
+// up.
+type categoryCache struct {
+	m map[string]TagCategory
+
+	// pending holds the tags being looked up, so they aren't looked up
+	// several times at once.
+	pending map[string]struct{}
+
+	// retry is when lookups may be tried again after one failed, and
+	// backoff is how long the next failure makes them wait.
+	retry   time.Time
+	backoff time.Duration
+
+	sync.Mutex
+}
+
+func (c *categoryCache) get(tag string) (TagCategory, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	v, ok := c.m[tag]
+	return v, ok
+}
+
+func (c *categoryCache) put(tag string, v TagCategory) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.m == nil || len(c.m) >= maxCachedCategories {
+		c.m = map[string]TagCategory{}
+	}
+
+	c.m[tag] = v
+}
+
+// missing returns the tags which aren't known.
+// Nothing is returned while backing off from a failed lookup.
+func (c *categoryCache) missing(tags []string) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.missingLocked(tags, false)
+}
+
+func (c *categoryCache) missingLocked(tags []string, skipPending bool) []string {
+	if time.Now().Before(c.retry) {
+		return nil
+	}
+
+	var out []string
+	for _, t := range tags {
+		if _, ok := c.m[t]; ok {
+			continue
+		}
+		if _, ok := c.pending[t]; ok && skipPending {
+			continue
+		}
+
+		out = append(out, t)
+	}
+
+	return out
+}
+
+// claim returns the tags which aren't known and aren't already being looked
+// up, marking them as being looked up.
+// They must be released once done.
+func (c *categoryCache) claim(tags []string) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.pending == nil {
+		c.pending = map[string]struct{}{}
+	}
+
+	out := c.missingLocked(tags, true)
+	for _, t := range out {
+		c.pending[t] = struct{}{}
+	}
+
+	return out
+}
+
+// done records how a lookup went, backing off from further lookups if it
+// failed.
+// Lookups cancelled by whoever asked for them don't count as failing.
+func (c *categoryCache) done(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if err == nil {
+		c.backoff = 0
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if c.backoff *= 2; c.backoff < minCategoryBackoff {
+		c.backoff = minCategoryBackoff
+	} else if c.backoff > maxCategoryBackoff {
+		c.backoff = maxCategoryBackoff
+	}
+	c.retry = time.Now().Add(c.backoff)
+}
+
+// release marks tags as no longer being looked up.
+func (c *categoryCache) release(tags []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, t := range tags {
+		delete(c.pending, t)
+	}
+}
+
+// categoryNames holds the names of each category, in order.
+var categoryNames = []string{"general", "artist", "copyright", "character", "meta"}
+
+// Categories lists every category, in the order they are usually shown.
+var Categories = []TagCategory{
+	CategoryArtist,
+	CategoryCopyright,
+	CategoryCharacter,
+	CategoryGeneral,
+	CategoryMeta,
+}
+
+// String returns the name of the category, such as "artist".
+func (c TagCategory) String() string {
+	if int(c) < 0 || int(c) >= len(categoryNames) {
+		return "general"
+	}
+	return categoryNames[c]
+}
+
+// MarshalText returns the name of the category.
+func (c TagCategory) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// ParseCategory returns the category with the given name.
+func ParseCategory(s string) (TagCategory, bool) {
+	for i, v := range categoryNames {
+		if v == s {
+			return TagCategory(i), true
+		}
+	}
+	return CategoryGeneral, false
+}
+
+// Category returns the category of a tag on this post.
+func (p *Post) Category(tag string) TagCategory {
+	return p.Categories[tag]
+}
+
+// categorize builds the categories of a post from lists of tags in each
+// category.
+// General tags aren't stored, as that is the default.
+func categorize(lists map[TagCategory][]string) map[string]TagCategory {
+	m := map[string]TagCategory{}
+	for c, tags := range lists {
+		if c == CategoryGeneral {
+			continue
+		}
+
+		for _, t := range tags {
+			if t != "" {
+				m[t] = c
+			}
+		}
+	}
+	return m
+}
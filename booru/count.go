@@ -0,0 +1,73 @@
+package booru
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// countTTL is how long the number of posts matching a query is
+	// remembered for.
+	countTTL = time.Minute
+)
+
+// Counter is implemented by APIs that can count the number of posts matching
+// a query.
+// Every API with CapTotal implements it.
+type Counter interface {
+	// Count returns the total number of posts matching a query.
+	// The cursors in the query are ignored.
+	Count(ctx context.Context, q Query) (int, error)
+}
+
+// countCache remembers the number of posts matching a query for a short time,
+// as counting is often expensive for the booru and is needed several times
+// for the same page.
+//
+// The zero-value is usable.
+type countCache struct {
+	m map[string]countEntry
+	sync.Mutex
+}
+
+type countEntry struct {
+	n int
+	t time.Time
+}
+
+func (c *countCache) get(k string) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.m[k]
+	if !ok || time.Since(e.t) > countTTL {
+		return 0, false
+	}
+
+	return e.n, true
+}
+
+func (c *countCache) put(k string, n int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.m == nil {
+		c.m = map[string]countEntry{}
+	}
+
+	// Clean out old entries while we're here
+	for k, v := range c.m {
+		if time.Since(v.t) > countTTL {
+			delete(c.m, k)
+		}
+	}
+
+	c.m[k] = countEntry{n: n, t: time.Now()}
+}
+
+// withoutCursors returns a copy of q with the cursors removed.
+func (q Query) withoutCursors() Query {
+	q.BeforeID, q.AfterID = 0, 0
+	return q
+}
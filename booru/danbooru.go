@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,7 +29,45 @@ type danbooru struct {
 	// Danbooru API.
 	HttpClient *http.Client
 
-	ua string
+	ua     string
+	name   string
+	hosts  []string
+	counts countCache
+	tags   tagCache
+}
+
+const (
+	// danbooruLimit is the default number of posts on a page.
+	danbooruLimit = 20
+
+	// danbooruMaxPage is the highest page number Danbooru allows for most
+	// users.
+	danbooruMaxPage = 1000
+
+	// danbooruTagChunk is how many tags are looked up in one request.
+	danbooruTagChunk = 100
+)
+
+// danbooruCounts is the response of /counts/posts.json.
+type danbooruCounts struct {
+	Counts struct {
+		// Posts is nil if Danbooru gave up counting.
+		Posts *int
+	}
+}
+
+// danbooruTag is a result of /autocomplete.json.
+type danbooruTag struct {
+	Value     string
+	Category  int
+	PostCount int `json:"post_count"`
+}
+
+// danbooruTagInfo is a result of /tags.json.
+type danbooruTagInfo struct {
+	Name      string
+	Category  int
+	PostCount int `json:"post_count"`
 }
 
 // danbooruPost holds some of the information returned by the Danbooru API.
@@ -48,21 +87,62 @@ type danbooruPost struct {
 	Ext         string `json:"file_ext"`
 	Size        int    `json:"file_size"`
 	OriginalUrl string `json:"file_url"`
-	ThumbUrl    string `json:"large_file_url"`
+	SampleUrl   string `json:"large_file_url"`
+	PreviewUrl  string `json:"preview_file_url"`
 	Width       int    `json:"image_width"`
 	Height      int    `json:"image_height"`
 	MD5         string `json:"md5"`
 
-	Tags string `json:"tag_string"`
+	MediaAsset struct {
+		Variants []danbooruVariant
+	} `json:"media_asset"`
+
+	Tags          string `json:"tag_string"`
+	TagsArtist    string `json:"tag_string_artist"`
+	TagsCopyright string `json:"tag_string_copyright"`
+	TagsCharacter string `json:"tag_string_character"`
+	TagsMeta      string `json:"tag_string_meta"`
 
 	Rating string
 }
 
+// danbooruVariant is a version of a file Danbooru has, such as "180x180",
+// "sample", or "original".
+type danbooruVariant struct {
+	Type   string
+	URL    string
+	Width  int
+	Height int
+	Ext    string `json:"file_ext"`
+}
+
+// danbooruDialect renders terms using Danbooru's syntax.
+type danbooruDialect struct{}
+
+var danbooruRatings = map[Rating]string{
+	General:      "g",
+	Questionable: "q",
+	Sensitive:    "s",
+	Explicit:     "e",
+}
+
+var danbooruOrders = map[string]string{
+	"id":        "id",
+	"score":     "score",
+	"updated":   "change",
+	"random":    "random",
+	"favorites": "favcount",
+	"filesize":  "filesize",
+	"mpixels":   "mpixels",
+	"comments":  "comment",
+}
+
 func init() {
 	registered["danbooru"] = func(cfg map[string]interface{}) (API, error) {
 		d := &danbooru{}
 
 		d.ua = cfg["agent"].(string)
+		d.name = cfg["name"].(string)
 		d.HttpClient = cfg["http"].(*http.Client)
 
 		u, err := url.Parse(cfg["url"].(string))
@@ -72,6 +152,11 @@ func init() {
 
 		d.URL = u
 
+		d.hosts, err = hostsFor(u, cfg)
+		if err != nil {
+			return nil, err
+		}
+
 		return d, nil
 	}
 }
@@ -95,15 +180,21 @@ func (dp danbooruPost) toPost(d *danbooru) Post {
 		r = Explicit
 	}
 
-	return Post{
+	p := Post{
 		Id:      dp.Id,
 		Score:   dp.Score,
 		Source:  dp.Source,
 		Created: dp.Created,
 		Updated: dp.Updated,
 		Tags:    strings.Split(dp.Tags, " "),
-		Rating:  r,
-		Hash:    dp.MD5,
+		Categories: categorize(map[TagCategory][]string{
+			CategoryArtist:    strings.Fields(dp.TagsArtist),
+			CategoryCopyright: strings.Fields(dp.TagsCopyright),
+			CategoryCharacter: strings.Fields(dp.TagsCharacter),
+			CategoryMeta:      strings.Fields(dp.TagsMeta),
+		}),
+		Rating: r,
+		Hash:   dp.MD5,
 		Original: Image{
 			Href:   dp.OriginalUrl,
 			MIME:   mime.TypeByExtension("." + dp.Ext), // mime asks we include the dot
@@ -111,13 +202,141 @@ func (dp danbooruPost) toPost(d *danbooru) Post {
 			Width:  dp.Width,
 			Height: dp.Height,
 		},
-		Thumbnail: Image{
-			Href: dp.ThumbUrl,
+		Sample: Image{
+			Href: dp.SampleUrl,
+			MIME: mime.TypeByExtension(path.Ext(dp.SampleUrl)),
+		},
+		Preview: Image{
+			Href: dp.PreviewUrl,
 			MIME: "image/jpeg", // assumption
-			Size: 0,            // we are never told
 		},
 		Origin: d,
 	}
+
+	// Newer versions of Danbooru tell us about every version of the file,
+	// including their sizes
+	var vs []Image
+	for _, v := range dp.MediaAsset.Variants {
+		img := Image{
+			Href:   v.URL,
+			MIME:   mime.TypeByExtension("." + v.Ext),
+			Width:  v.Width,
+			Height: v.Height,
+		}
+
+		switch img.Href {
+		case p.Sample.Href:
+			p.Sample = img
+		case p.Preview.Href:
+			p.Preview = img
+		case p.Original.Href:
+			// We know more about the original already
+			img = p.Original
+		}
+
+		vs = append(vs, img)
+	}
+
+	if len(vs) == 0 {
+		vs = []Image{p.Preview, p.Sample, p.Original}
+	}
+	p.Variants = variants(vs...)
+
+	return p
+}
+
+func (danbooruDialect) render(t Term) ([]string, bool) {
+	neg := ""
+	if t.Negate {
+		neg = "-"
+	}
+
+	switch t.Kind {
+	case TermRating:
+		rs := make([]string, len(t.Ratings))
+		for i, v := range t.Ratings {
+			rs[i] = danbooruRatings[v]
+		}
+		return []string{neg + "rating:" + strings.Join(rs, ",")}, true
+	case TermOrder:
+		k, ok := danbooruOrders[t.Value]
+		if !ok || t.Negate {
+			return nil, false
+		}
+
+		// Danbooru sorts IDs in ascending order by default, and everything
+		// else in descending order
+		def := "desc"
+		if k == "id" {
+			def = "asc"
+		}
+
+		if k != "random" && t.Op != def {
+			k += "_" + t.Op
+		}
+		return []string{"order:" + k}, true
+	case TermScore, TermID, TermDate:
+		op := t.Op
+		if op == "=" {
+			op = ""
+		}
+		return []string{neg + compareNames[t.Kind] + ":" + op + t.Value}, true
+	case TermOr:
+		ss := make([]string, 0, len(t.Any))
+		for _, v := range t.Any {
+			r, ok := danbooruDialect{}.render(v)
+			if !ok || len(r) != 1 || v.Kind == TermOrder {
+				return nil, false
+			}
+			ss = append(ss, r[0])
+		}
+		return []string{neg + "(" + strings.Join(ss, " or ") + ")"}, true
+	case TermAnd:
+		ss := make([]string, 0, len(t.Any))
+		for _, v := range t.Any {
+			r, ok := danbooruDialect{}.render(v)
+			if !ok || v.Kind == TermOrder {
+				return nil, false
+			}
+			ss = append(ss, r...)
+		}
+		return []string{neg + "(" + strings.Join(ss, " ") + ")"}, true
+	}
+
+	return []string{neg + t.Value}, true
+}
+
+// Translate renders a query using Danbooru's syntax.
+func (d *danbooru) Translate(q Query) ([]string, []Term) {
+	t := q.terms()
+
+	// Danbooru takes cursors in the page parameter, but only one of them
+	if q.BeforeID != 0 && q.AfterID != 0 {
+		t = append(t, Term{Kind: TermID, Op: ">", Value: strconv.Itoa(q.AfterID)})
+	}
+
+	return translate(danbooruDialect{}, t)
+}
+
+// Capabilities returns the features supported by Danbooru.
+func (d *danbooru) Capabilities() Capability {
+	return CapTotal | CapCursor | CapAutocomplete | CapTagCounts
+}
+
+// MaxPage returns the highest page Danbooru lets us ask for.
+// It doesn't depend on how many posts are on each page.
+func (d *danbooru) MaxPage(limit int) int {
+	return danbooruMaxPage - 1
+}
+
+// Name returns the name this booru was configured with.
+func (d *danbooru) Name() string {
+	return d.name
+}
+
+// Hosts returns the hosts this booru serves files from.
+func (d *danbooru) Hosts() []string {
+	return d.hosts
 }
 
 // HTTP returns the HttpClient that this booru uses.
@@ -131,8 +350,20 @@ func (d *danbooru) Page(ctx context.Context, q Query, page int) ([]Post, int, er
 
 	u.Path = path.Join(u.Path, "posts.json")
 	uq := u.Query()
-	uq.Set("page", fmt.Sprint(page))
-	uq.Set("tags", strings.Join(q.Tags, " "))
+	tags, _ := d.Translate(q)
+	switch {
+	case q.BeforeID != 0:
+		uq.Set("page", fmt.Sprintf("b%d", q.BeforeID))
+	case q.AfterID != 0:
+		uq.Set("page", fmt.Sprintf("a%d", q.AfterID))
+	default:
+		// Danbooru starts counting pages at 1
+		uq.Set("page", fmt.Sprint(page+1))
+	}
+	if q.Limit > 0 {
+		uq.Set("limit", fmt.Sprint(q.Limit))
+	}
+	uq.Set("tags", strings.Join(tags, " "))
 	u.RawQuery = uq.Encode()
 
 	// Create a request object
@@ -143,6 +374,37 @@ func (d *danbooru) Page(ctx context.Context, q Query, page int) ([]Post, int, er
 
 	req.Header.Set("User-Agent", d.ua)
 
+	// Count the posts while we wait for them, so we know how many pages
+	// there are.
+	// This doesn't mean anything when using cursors.
+	remaining := make(chan int, 1)
+	if q.BeforeID == 0 && q.AfterID == 0 {
+		go func() {
+			n, err := d.Count(ctx, q)
+			if err != nil {
+				remaining <- -1
+				return
+			}
+
+			limit := q.Limit
+			if limit == 0 {
+				limit = danbooruLimit
+			}
+
+			pages := (n + limit - 1) / limit
+			if pages > danbooruMaxPage {
+				pages = danbooruMaxPage
+			}
+
+			if pages -= page; pages < 0 {
+				pages = 0
+			}
+			remaining <- pages
+		}()
+	} else {
+		remaining <- -1
+	}
+
 	// Do the needful
 	res, err := d.HttpClient.Do(req)
 	if err != nil {
@@ -167,7 +429,169 @@ func (d *danbooru) Page(ctx context.Context, q Query, page int) ([]Post, int, er
 		out[i] = v.toPost(d)
 	}
 
-	return out, -1, nil
+	return out, <-remaining, nil
+}
+
+// Count returns the number of posts matching a query.
+func (d *danbooru) Count(ctx context.Context, q Query) (int, error) {
+	tags, _ := d.Translate(q.withoutCursors())
+	key := strings.Join(tags, " ")
+
+	if n, ok := d.counts.get(key); ok {
+		return n, nil
+	}
+
+	// Copy our URL object so we can set the query
+	u := *d.URL
+
+	u.Path = path.Join(u.Path, "counts/posts.json")
+	uq := u.Query()
+	uq.Set("tags", key)
+	u.RawQuery = uq.Encode()
+
+	// Create a request object
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("User-Agent", d.ua)
+
+	// Do the needful
+	res, err := d.HttpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		// Something bad happened, ditch
+		return 0, newHTTPError(res)
+	}
+
+	var rawCounts danbooruCounts
+	if err := json.NewDecoder(res.Body).Decode(&rawCounts); err != nil {
+		return 0, err
+	}
+
+	if rawCounts.Counts.Posts == nil {
+		return 0, fmt.Errorf("danbooru: count timed out")
+	}
+
+	d.counts.put(key, *rawCounts.Counts.Posts)
+	return *rawCounts.Counts.Posts, nil
+}
+
+// Tags returns the most used tags starting with prefix.
+// Danbooru also suggests tags that are aliased to, or are close to, the
+// prefix.
+func (d *danbooru) Tags(ctx context.Context, prefix string) ([]Tag, error) {
+	// Copy our URL object so we can set the query
+	u := *d.URL
+
+	u.Path = path.Join(u.Path, "autocomplete.json")
+	uq := u.Query()
+	uq.Set("search[query]", prefix)
+	uq.Set("search[type]", "tag_query")
+	uq.Set("limit", fmt.Sprint(TagLimit))
+	uq.Set("version", "1")
+	u.RawQuery = uq.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", d.ua)
+
+	res, err := d.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, newHTTPError(res)
+	}
+
+	var rawTags []danbooruTag
+	if err := json.NewDecoder(res.Body).Decode(&rawTags); err != nil {
+		return nil, err
+	}
+
+	// Aliases show up as their own results, but with the same value
+	out := make([]Tag, 0, len(rawTags))
+	seen := map[string]struct{}{}
+	for _, v := range rawTags {
+		if _, ok := seen[v.Value]; ok || v.Value == "" {
+			continue
+		}
+		seen[v.Value] = struct{}{}
+
+		out = append(out, Tag{Name: v.Value, Count: v.PostCount, Category: tagTypes[v.Category]})
+	}
+
+	return out, nil
+}
+
+// LookupTags returns the tags with the given names.
+func (d *danbooru) LookupTags(ctx context.Context, names []string) ([]Tag, error) {
+	return lookupTags(ctx, &d.tags, names, danbooruTagChunk, d.fetchTags)
+}
+
+// fetchTags asks Danbooru for tags by name.
+func (d *danbooru) fetchTags(ctx context.Context, names []string) ([]Tag, error) {
+	// Names are separated by commas, so tags with one in them can't be
+	// looked up
+	ok := make([]string, 0, len(names))
+	for _, v := range names {
+		if !strings.Contains(v, ",") {
+			ok = append(ok, v)
+		}
+	}
+
+	if len(ok) == 0 {
+		return nil, nil
+	}
+
+	// Copy our URL object so we can set the query
+	u := *d.URL
+
+	u.Path = path.Join(u.Path, "tags.json")
+	uq := u.Query()
+	uq.Set("search[name_comma]", strings.Join(ok, ","))
+	uq.Set("limit", fmt.Sprint(len(ok)))
+	uq.Set("only", "name,category,post_count")
+	u.RawQuery = uq.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", d.ua)
+
+	res, err := d.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, newHTTPError(res)
+	}
+
+	var rawTags []danbooruTagInfo
+	if err := json.NewDecoder(res.Body).Decode(&rawTags); err != nil {
+		return nil, err
+	}
+
+	out := make([]Tag, len(rawTags))
+	for i, v := range rawTags {
+		out[i] = Tag{Name: v.Name, Count: v.PostCount, Category: tagTypes[v.Category]}
+	}
+
+	return out, nil
 }
 
 func (d *danbooru) Post(ctx context.Context, id int) (*Post, error) {
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,7 +30,12 @@ type gelbooru struct {
 	// gelbooru API.
 	HttpClient *http.Client
 
-	ua string
+	ua     string
+	name   string
+	hosts  []string
+	cats   categoryCache
+	tags   tagCache
+	counts countCache
 }
 
 // gelbooruPost holds some of the information returned by the gelbooru API.
@@ -47,12 +53,15 @@ type gelbooruPost struct {
 	Source string
 
 	OriginalUrl string `json:"file_url"`
-	ThumbUrl    string `json:"preview_url"`
+	SampleUrl   string `json:"sample_url"`
+	PreviewUrl  string `json:"preview_url"`
 	MD5         string `json:"md5"`
 
 	Tags string `json:"tags"`
 
 	Width, Height int
+	SampleWidth   int `json:"sample_width"`
+	SampleHeight  int `json:"sample_height"`
 	PreviewWidth  int `json:"preview_width"`
 	PreviewHeight int `json:"preview_height"`
 
@@ -66,11 +75,64 @@ type gelbooruResp struct {
 	Post []gelbooruPost
 }
 
+// gelbooruTagResp is the response of the tag API.
+type gelbooruTagResp struct {
+	Tag []struct {
+		Name  string
+		Count int
+		Type  int
+	}
+}
+
+const (
+	// gelbooruLimit is the default number of posts on a page.
+	gelbooruLimit = 100
+
+	// gelbooruMaxOffset is how many posts into the results Gelbooru lets
+	// pages start at.
+	gelbooruMaxOffset = 20000
+
+	// gelbooruTagChunk is how many tags are looked up in one request.
+	gelbooruTagChunk = 100
+)
+
+// categoryLookupTimeout is how long looking up the categories of tags in the
+// background may take.
+const categoryLookupTimeout = 30 * time.Second
+
+// gelbooruDialect renders terms using Gelbooru's syntax.
+type gelbooruDialect struct{}
+
+var gelbooruRatings = map[Rating]string{
+	General:      "general",
+	Questionable: "questionable",
+	Sensitive:    "sensitive",
+	Explicit:     "explicit",
+}
+
+var gelbooruOrders = map[string]string{
+	"id":      "id",
+	"score":   "score",
+	"updated": "updated",
+	"random":  "random",
+	"width":   "width",
+	"height":  "height",
+}
+
+// invertOp maps a comparison operator to the one that matches the opposite.
+var invertOp = map[string]string{
+	"<":  ">=",
+	"<=": ">",
+	">":  "<=",
+	">=": "<",
+}
+
 func init() {
 	registered["gelbooru"] = func(cfg map[string]interface{}) (API, error) {
 		g := &gelbooru{}
 
 		g.ua = cfg["agent"].(string)
+		g.name = cfg["name"].(string)
 		g.HttpClient = cfg["http"].(*http.Client)
 
 		u, err := url.Parse(cfg["url"].(string))
@@ -80,6 +142,11 @@ func init() {
 
 		g.URL = u
 
+		g.hosts, err = hostsFor(u, cfg)
+		if err != nil {
+			return nil, err
+		}
+
 		return g, nil
 	}
 }
@@ -101,8 +168,8 @@ func (dp gelbooruPost) toPost(d *gelbooru) Post {
 			Width:  dp.Width,
 			Height: dp.Height,
 		},
-		Thumbnail: Image{
-			Href:   dp.ThumbUrl,
+		Preview: Image{
+			Href:   dp.PreviewUrl,
 			MIME:   "image/jpeg", // assumption
 			Size:   0,            // we are never told
 			Width:  dp.PreviewWidth,
@@ -111,6 +178,19 @@ func (dp gelbooruPost) toPost(d *gelbooru) Post {
 		Origin: d,
 	}
 
+	// Samples are only made for large images
+	p.Sample = p.Original
+	if dp.SampleUrl != "" {
+		p.Sample = Image{
+			Href:   dp.SampleUrl,
+			MIME:   mime.TypeByExtension(path.Ext(dp.SampleUrl)),
+			Width:  dp.SampleWidth,
+			Height: dp.SampleHeight,
+		}
+	}
+
+	p.Variants = variants(p.Preview, p.Sample, p.Original)
+
 	switch dp.Rating {
 	default:
 		fallthrough
@@ -130,6 +210,156 @@ func (dp gelbooruPost) toPost(d *gelbooru) Post {
 	return p
 }
 
+func (gelbooruDialect) render(t Term) ([]string, bool) {
+	switch t.Kind {
+	case TermRating:
+		rs := make([]string, len(t.Ratings))
+		for i, v := range t.Ratings {
+			rs[i] = "rating:" + gelbooruRatings[v]
+			if t.Negate {
+				rs[i] = "-" + rs[i]
+			}
+		}
+
+		if len(rs) == 1 || t.Negate {
+			return rs, true
+		}
+		return []string{"{" + strings.Join(rs, " ~ ") + "}"}, true
+	case TermOrder:
+		k, ok := gelbooruOrders[t.Value]
+		if !ok || t.Negate {
+			return nil, false
+		}
+
+		if k == "random" {
+			return []string{"sort:random"}, true
+		}
+		return []string{"sort:" + k + ":" + t.Op}, true
+	case TermDate, TermAnd:
+		// Gelbooru can't group terms together inside of {a ~ b}
+		return nil, false
+	case TermScore, TermID:
+		// Gelbooru only understands inclusive comparisons and can't negate
+		// them, so they're rewritten
+		op := t.Op
+		if t.Negate {
+			o, ok := invertOp[op]
+			if !ok {
+				return nil, false
+			}
+			op = o
+		}
+
+		name := compareNames[t.Kind]
+		n, _ := strconv.Atoi(t.Value)
+		switch op {
+		case "=":
+			return []string{fmt.Sprintf("%s:%d", name, n)}, true
+		case ">":
+			op, n = ">=", n+1
+		case "<":
+			op, n = "<=", n-1
+		}
+		return []string{fmt.Sprintf("%s:%s%d", name, op, n)}, true
+	case TermOr:
+		ss := make([]string, 0, len(t.Any))
+		for _, v := range t.Any {
+			if v.Kind == TermOrder || v.Kind == TermOr {
+				return nil, false
+			}
+
+			// -{a ~ b} isn't supported, but -a -b means the same thing
+			if t.Negate {
+				v.Negate = !v.Negate
+			} else if v.Kind == TermRating && !v.Negate {
+				// Flatten ratings into the group instead of nesting them
+				for _, r := range v.Ratings {
+					ss = append(ss, "rating:"+gelbooruRatings[r])
+				}
+				continue
+			}
+
+			r, ok := gelbooruDialect{}.render(v)
+			if !ok || (len(r) != 1 && !t.Negate) {
+				return nil, false
+			}
+			ss = append(ss, r...)
+		}
+
+		if t.Negate {
+			return ss, true
+		}
+		return []string{"{" + strings.Join(ss, " ~ ") + "}"}, true
+	}
+
+	if t.Negate {
+		return []string{"-" + t.Value}, true
+	}
+	return []string{t.Value}, true
+}
+
+// Translate renders a query using Gelbooru's syntax.
+func (d *gelbooru) Translate(q Query) ([]string, []Term) {
+	t := q.terms()
+
+	// Gelbooru has no cursors, but searching by ID does the same thing
+	if q.BeforeID != 0 {
+		t = append(t, Term{Kind: TermID, Op: "<", Value: strconv.Itoa(q.BeforeID)})
+	}
+	if q.AfterID != 0 {
+		t = append(t, Term{Kind: TermID, Op: ">", Value: strconv.Itoa(q.AfterID)})
+	}
+
+	if gelbooruReversed(q) {
+		t = append(t, Term{Kind: TermOrder, Value: "id", Op: "asc"})
+	}
+
+	return translate(gelbooruDialect{}, t)
+}
+
+// gelbooruReversed determines if results have to be fetched oldest first, and
+// reversed afterwards.
+// This is needed for Query.AfterID to act like a cursor, as otherwise the
+// newest posts would be returned instead of the ones right after it.
+func gelbooruReversed(q Query) bool {
+	if q.AfterID == 0 || q.BeforeID != 0 || q.Order != "" {
+		return false
+	}
+
+	for _, t := range ParseTags(q.Tags) {
+		if t.Kind == TermOrder {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Capabilities returns the features supported by Gelbooru.
+func (d *gelbooru) Capabilities() Capability {
+	// Cursors are emulated by searching by ID
+	return CapTotal | CapCursor | CapAutocomplete | CapTagCounts
+}
+
+// MaxPage returns the highest page Gelbooru lets us ask for with limit posts
+// on each page.
+func (d *gelbooru) MaxPage(limit int) int {
+	if limit <= 0 {
+		limit = gelbooruLimit
+	}
+	return gelbooruMaxOffset/limit - 1
+}
+
+// Name returns the name this booru was configured with.
+func (d *gelbooru) Name() string {
+	return d.name
+}
+
+// Hosts returns the hosts this booru serves files from.
+func (d *gelbooru) Hosts() []string {
+	return d.hosts
+}
+
 // HTTP returns the HttpClient that this booru uses.
 func (d *gelbooru) HTTP() *http.Client {
 	return d.HttpClient
@@ -144,8 +374,12 @@ func (d *gelbooru) Page(ctx context.Context, q Query, page int) ([]Post, int, er
 	uq.Set("page", "dapi")
 	uq.Set("s", "post")
 	uq.Set("q", "index")
+	tags, _ := d.Translate(q)
 	uq.Set("pid", fmt.Sprint(page))
-	uq.Set("tags", strings.Join(q.Tags, " "))
+	if q.Limit > 0 {
+		uq.Set("limit", fmt.Sprint(q.Limit))
+	}
+	uq.Set("tags", strings.Join(tags, " "))
 	uq.Set("json", "1")
 	u.RawQuery = uq.Encode()
 
@@ -182,7 +416,85 @@ func (d *gelbooru) Page(ctx context.Context, q Query, page int) ([]Post, int, er
 		out[i] = v.toPost(d)
 	}
 
-	return out, int(math.Ceil(float64(rawResp.A.Total-rawResp.A.Offset) / float64(rawResp.A.Limit))), nil
+	d.categorize(out)
+
+	if gelbooruReversed(q) {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+
+	// Cursors change the total, so only remember it without them
+	if q.BeforeID == 0 && q.AfterID == 0 {
+		d.counts.put(strings.Join(tags, " "), rawResp.A.Total)
+	}
+
+	if rawResp.A.Limit == 0 {
+		return out, -1, nil
+	}
+
+	remaining := int(math.Ceil(float64(rawResp.A.Total-rawResp.A.Offset) / float64(rawResp.A.Limit)))
+	if max := d.MaxPage(rawResp.A.Limit) - page + 1; remaining > max {
+		remaining = max
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return out, remaining, nil
+}
+
+// Count returns the number of posts matching a query.
+func (d *gelbooru) Count(ctx context.Context, q Query) (int, error) {
+	tags, _ := d.Translate(q.withoutCursors())
+	key := strings.Join(tags, " ")
+
+	if n, ok := d.counts.get(key); ok {
+		return n, nil
+	}
+
+	// Copy our URL object so we can set the query
+	u := *d.URL
+
+	// There's no dedicated way to count posts; fetch as little as possible
+	// and look at the total
+	u.Path = path.Join(u.Path, "/index.php")
+	uq := u.Query()
+	uq.Set("page", "dapi")
+	uq.Set("s", "post")
+	uq.Set("q", "index")
+	uq.Set("limit", "1")
+	uq.Set("tags", key)
+	uq.Set("json", "1")
+	u.RawQuery = uq.Encode()
+
+	// Create a request object
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("User-Agent", d.ua)
+
+	// Do the needful
+	res, err := d.HttpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		// Something bad happened, ditch
+		return 0, newHTTPError(res)
+	}
+
+	var rawResp gelbooruResp
+	if err := json.NewDecoder(res.Body).Decode(&rawResp); err != nil {
+		return 0, err
+	}
+
+	d.counts.put(key, rawResp.A.Total)
+	return rawResp.A.Total, nil
 }
 
 func (d *gelbooru) Post(ctx context.Context, id int) (*Post, error) {
@@ -229,6 +541,182 @@ func (d *gelbooru) Post(ctx context.Context, id int) (*Post, error) {
 		return nil, fmt.Errorf("gelbooru: not found")
 	}
 
-	out := rawResp.Post[0].toPost(d)
-	return &out, nil
+	out := []Post{rawResp.Post[0].toPost(d)}
+	d.categorize(out)
+	return &out[0], nil
+}
+
+// categorize fills in the categories of the tags on posts that we know of.
+// The ones we don't know yet are looked up in the background, so they are
+// known next time without making anybody wait on them now; Categorize is
+// there for when something can't wait.
+func (d *gelbooru) categorize(posts []Post) {
+	if unknown := d.cats.claim(tagsOf(posts)); len(unknown) > 0 {
+		go func() {
+			defer d.cats.release(unknown)
+
+			ctx, cancel := context.WithTimeout(context.Background(), categoryLookupTimeout)
+			defer cancel()
+
+			d.lookupCategories(ctx, unknown)
+		}()
+	}
+
+	d.fillCategories(posts)
+}
+
+// Categorize fills in the categories of the tags on posts, looking up the
+// ones we don't know yet.
+func (d *gelbooru) Categorize(ctx context.Context, posts []Post) error {
+	var err error
+	if unknown := d.cats.missing(tagsOf(posts)); len(unknown) > 0 {
+		err = d.lookupCategories(ctx, unknown)
+	}
+
+	d.fillCategories(posts)
+	return err
+}
+
+// lookupCategories looks up the categories of tags, remembering them.
+func (d *gelbooru) lookupCategories(ctx context.Context, tags []string) error {
+	// Tags may still be remembered from before, so take their categories
+	// from whatever comes back
+	found, err := d.LookupTags(ctx, tags)
+	for _, v := range found {
+		d.cats.put(v.Name, v.Category)
+	}
+
+	d.cats.done(err)
+	return err
+}
+
+// fillCategories sets the categories of posts to what we know of them.
+func (d *gelbooru) fillCategories(posts []Post) {
+	for i := range posts {
+		m := map[string]TagCategory{}
+		for _, t := range posts[i].Tags {
+			if c, ok := d.cats.get(t); ok && c != CategoryGeneral {
+				m[t] = c
+			}
+		}
+		posts[i].Categories = m
+	}
+}
+
+// tagsOf lists every tag on posts once.
+func tagsOf(posts []Post) []string {
+	var out []string
+	seen := map[string]struct{}{}
+	for _, p := range posts {
+		for _, t := range p.Tags {
+			if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			out = append(out, t)
+		}
+	}
+
+	return out
+}
+
+// LookupTags returns the tags with the given names.
+func (d *gelbooru) LookupTags(ctx context.Context, names []string) ([]Tag, error) {
+	return lookupTags(ctx, &d.tags, names, gelbooruTagChunk, d.fetchTags)
+}
+
+// fetchTags asks Gelbooru for tags by name, remembering their categories.
+func (d *gelbooru) fetchTags(ctx context.Context, names []string) ([]Tag, error) {
+	uq := url.Values{}
+	uq.Set("names", strings.Join(names, " "))
+	uq.Set("limit", fmt.Sprint(len(names)))
+
+	rawResp, err := d.tagIndex(ctx, uq)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Tag, len(rawResp.Tag))
+	for i, v := range rawResp.Tag {
+		out[i] = Tag{Name: v.Name, Count: v.Count, Category: tagTypes[v.Type]}
+		d.cats.put(v.Name, out[i].Category)
+	}
+
+	// Tags Gelbooru doesn't know about are general, so they aren't looked
+	// up again
+	for _, v := range names {
+		if _, ok := d.cats.get(v); !ok {
+			d.cats.put(v, CategoryGeneral)
+		}
+	}
+
+	return out, nil
+}
+
+// Tags returns the most used tags starting with prefix.
+func (d *gelbooru) Tags(ctx context.Context, prefix string) ([]Tag, error) {
+	uq := url.Values{}
+	// This is an SQL pattern, so "_" matches any character; tags which
+	// don't actually start with prefix are thrown out afterwards
+	uq.Set("name_pattern", prefix+"%")
+	uq.Set("orderby", "count")
+	uq.Set("order", "desc")
+	uq.Set("limit", fmt.Sprint(TagLimit))
+
+	rawResp, err := d.tagIndex(ctx, uq)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Tag, 0, len(rawResp.Tag))
+	for _, v := range rawResp.Tag {
+		d.cats.put(v.Name, tagTypes[v.Type])
+
+		if strings.HasPrefix(v.Name, prefix) {
+			out = append(out, Tag{Name: v.Name, Count: v.Count, Category: tagTypes[v.Type]})
+		}
+	}
+
+	return out, nil
+}
+
+// tagIndex lists tags using the tag API, with the given parameters.
+func (d *gelbooru) tagIndex(ctx context.Context, params url.Values) (*gelbooruTagResp, error) {
+	// Copy our URL object so we can set the query
+	u := *d.URL
+
+	u.Path = path.Join(u.Path, "/index.php")
+	uq := u.Query()
+	uq.Set("page", "dapi")
+	uq.Set("s", "tag")
+	uq.Set("q", "index")
+	uq.Set("json", "1")
+	for k, v := range params {
+		uq[k] = v
+	}
+	u.RawQuery = uq.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", d.ua)
+
+	res, err := d.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, newHTTPError(res)
+	}
+
+	var rawResp gelbooruTagResp
+	if err := json.NewDecoder(res.Body).Decode(&rawResp); err != nil {
+		return nil, err
+	}
+
+	return &rawResp, nil
 }
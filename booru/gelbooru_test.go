@@ -0,0 +1,75 @@
+package booru
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestGelbooru(t *testing.T, h http.HandlerFunc) *gelbooru {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	b, err := New("gelbooru", map[string]interface{}{
+		"agent": "test",
+		"http":  srv.Client(),
+		"url":   srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*gelbooru)
+}
+
+func TestGelbooruCategorize(t *testing.T) {
+	var calls int32
+	g := newTestGelbooru(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, `{"tag": [{"name": "kantoku", "count": 10, "type": 1}]}`)
+	})
+
+	posts := []Post{{Tags: []string{"kantoku", "1girl"}}}
+	if err := g.Categorize(context.Background(), posts); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := posts[0].Category("kantoku"); c != CategoryArtist {
+		t.Errorf("kantoku is %v, want artist", c)
+	}
+	if c := posts[0].Category("1girl"); c != CategoryGeneral {
+		t.Errorf("1girl is %v, want general", c)
+	}
+
+	// Everything is known now
+	posts = []Post{{Tags: []string{"kantoku", "1girl"}}}
+	g.Categorize(context.Background(), posts)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("looked up tags %d times, want 1", n)
+	}
+	if c := posts[0].Category("kantoku"); c != CategoryArtist {
+		t.Errorf("kantoku is %v, want artist", c)
+	}
+}
+
+func TestGelbooruCategorizeBackoff(t *testing.T) {
+	var calls int32
+	g := newTestGelbooru(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	for i := 0; i < 3; i++ {
+		posts := []Post{{Tags: []string{"kantoku"}}}
+		err := g.Categorize(context.Background(), posts)
+		if i == 0 && err == nil {
+			t.Errorf("lookup succeeded, expected an error")
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("looked up tags %d times after failing, want 1", n)
+	}
+}
@@ -0,0 +1,66 @@
+package booru
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Hoster is implemented by APIs that know which hosts their files are served
+// from.
+type Hoster interface {
+	// Hosts returns the hosts files may be fetched from.
+	// A host starting with "*." also matches any of its subdomains.
+	Hosts() []string
+}
+
+// HostsOf returns the hosts b serves files from, or nil if it doesn't know.
+func HostsOf(b API) []string {
+	if h, ok := b.(Hoster); ok {
+		return h.Hosts()
+	}
+	return nil
+}
+
+// MatchHost reports whether host is matched by any of the patterns, as
+// returned by Hoster.
+func MatchHost(patterns []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "*.") {
+			base := p[2:]
+			if host == base || strings.HasSuffix(host, "."+base) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostsFor works out the hosts a booru at u serves files from.
+// This is u's host and the "hosts" key of cfg; subdomains are only trusted if
+// they are listed there, as the parent domain of a booru isn't necessarily
+// run by the same people, such as with "user.github.io".
+func hostsFor(u *url.URL, cfg map[string]interface{}) ([]string, error) {
+	hosts := []string{strings.ToLower(u.Hostname())}
+
+	switch v := cfg["hosts"].(type) {
+	case nil:
+	case []interface{}:
+		for _, h := range v {
+			s, ok := h.(string)
+			if !ok {
+				return nil, fmt.Errorf("hosts must be a list of strings")
+			}
+			hosts = append(hosts, strings.ToLower(s))
+		}
+	default:
+		return nil, fmt.Errorf("hosts must be a list of strings")
+	}
+
+	return hosts, nil
+}
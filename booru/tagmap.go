@@ -0,0 +1,254 @@
+package booru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+)
+
+// TagMap holds tag aliases and implications, which are used to normalise the
+// tags of posts so the same concept has the same name across every booru.
+//
+// The zero-value, and a nil TagMap, leave tags untouched.
+type TagMap struct {
+	// Aliases maps a tag to the name it should be known by.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Implications maps a tag to other tags which are implied by it.
+	// For example, "hatsune_miku" implies "vocaloid".
+	Implications map[string][]string `json:"implications,omitempty"`
+}
+
+// danbooruTagRelation is an entry of Danbooru's tag_aliases.json or
+// tag_implications.json.
+type danbooruTagRelation struct {
+	Id         int
+	Antecedent string `json:"antecedent_name"`
+	Consequent string `json:"consequent_name"`
+}
+
+const (
+	// tagMapFetchLimit is the amount of relations asked for in one request
+	// when fetching a TagMap.
+	tagMapFetchLimit = 1000
+
+	// tagMapMaxDepth is how far aliases are followed before giving up, in
+	// case of cycles.
+	tagMapMaxDepth = 8
+)
+
+// LoadTagMap reads a TagMap from a JSON file.
+func LoadTagMap(name string) (*TagMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &TagMap{}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("failed reading tag map %s: %w", name, err)
+	}
+
+	return m, nil
+}
+
+// Save writes the TagMap to a JSON file, which can be read back using
+// LoadTagMap.
+func (m *TagMap) Save(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// FetchTagMap downloads every active alias and implication from a Danbooru
+// instance, such as "https://danbooru.donmai.us".
+//
+// This makes a lot of requests, so the result should be saved and reused.
+func FetchTagMap(ctx context.Context, c *http.Client, base, ua string) (*TagMap, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &TagMap{
+		Aliases:      map[string]string{},
+		Implications: map[string][]string{},
+	}
+
+	err = fetchTagRelations(ctx, c, u, ua, "tag_aliases.json", func(r danbooruTagRelation) {
+		m.Aliases[r.Antecedent] = r.Consequent
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = fetchTagRelations(ctx, c, u, ua, "tag_implications.json", func(r danbooruTagRelation) {
+		m.Implications[r.Antecedent] = append(m.Implications[r.Antecedent], r.Consequent)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// fetchTagRelations pages through one of Danbooru's tag relation endpoints
+// using ID cursors, calling fn for every active relation.
+func fetchTagRelations(ctx context.Context, c *http.Client, base *url.URL, ua, endpoint string, fn func(danbooruTagRelation)) error {
+	cursor := 0
+
+	for {
+		u := *base
+		u.Path = path.Join(u.Path, endpoint)
+
+		v := url.Values{}
+		v.Set("search[status]", "active")
+		v.Set("limit", strconv.Itoa(tagMapFetchLimit))
+		if cursor > 0 {
+			v.Set("page", "b"+strconv.Itoa(cursor))
+		}
+		u.RawQuery = v.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", ua)
+
+		res, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != 200 {
+			res.Body.Close()
+			return newHTTPError(res)
+		}
+
+		var rs []danbooruTagRelation
+		err = json.NewDecoder(res.Body).Decode(&rs)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rs {
+			fn(r)
+			if cursor == 0 || r.Id < cursor {
+				cursor = r.Id
+			}
+		}
+
+		if len(rs) < tagMapFetchLimit {
+			return nil
+		}
+	}
+}
+
+// Alias returns the name tag should be known by.
+// Tags in a cycle of aliases are all known by the first of them in sorted
+// order.
+func (m *TagMap) Alias(tag string) string {
+	if m == nil {
+		return tag
+	}
+
+	seen := make([]string, 0, tagMapMaxDepth)
+	for i := 0; i < tagMapMaxDepth; i++ {
+		seen = append(seen, tag)
+
+		a, ok := m.Aliases[tag]
+		if !ok || a == tag {
+			break
+		}
+
+		// In a cycle, every tag in it is known by the same name no matter
+		// where it was entered, so they still end up as one tag
+		for j, v := range seen {
+			if v != a {
+				continue
+			}
+
+			min := a
+			for _, c := range seen[j:] {
+				if c < min {
+					min = c
+				}
+			}
+			return min
+		}
+
+		tag = a
+	}
+
+	return tag
+}
+
+// Normalize renames aliased tags and adds any tags they imply.
+// Duplicates are removed; the order of tags is otherwise kept, with implied
+// tags placed at the end.
+func (m *TagMap) Normalize(tags []string) []string {
+	if m == nil || (len(m.Aliases) == 0 && len(m.Implications) == 0) {
+		return tags
+	}
+
+	seen := make(map[string]struct{}, len(tags))
+	out := make([]string, 0, len(tags))
+
+	add := func(t string) {
+		t = m.Alias(t)
+		if _, ok := seen[t]; ok {
+			return
+		}
+		seen[t] = struct{}{}
+		out = append(out, t)
+	}
+
+	for _, t := range tags {
+		add(t)
+	}
+
+	// out grows as implications are added, so implications of implied tags
+	// are found too
+	for i := 0; i < len(out); i++ {
+		for _, t := range m.Implications[out[i]] {
+			add(t)
+		}
+	}
+
+	return out
+}
+
+// NormalizePost normalizes the tags of a post, keeping the categories of
+// tags that were renamed.
+func (m *TagMap) NormalizePost(p *Post) {
+	if m == nil || (len(m.Aliases) == 0 && len(m.Implications) == 0) {
+		return
+	}
+
+	p.Tags = m.Normalize(p.Tags)
+
+	if len(p.Categories) == 0 {
+		return
+	}
+
+	cats := make(map[string]TagCategory, len(p.Categories))
+	for t, c := range p.Categories {
+		cats[m.Alias(t)] = c
+	}
+	p.Categories = cats
+}
@@ -0,0 +1,90 @@
+package booru
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTagMapAlias(t *testing.T) {
+	m := &TagMap{Aliases: map[string]string{
+		"miku_hatsune": "hatsune_miku",
+		"miku":         "miku_hatsune",
+		"self":         "self",
+
+		// Cycles
+		"b": "a",
+		"a": "b",
+		"z": "x",
+		"x": "y",
+		"y": "z",
+		"w": "x",
+
+		// Longer than tagMapMaxDepth
+		"c0": "c1", "c1": "c2", "c2": "c3", "c3": "c4", "c4": "c5",
+		"c5": "c6", "c6": "c7", "c7": "c8", "c8": "c9", "c9": "c10",
+	}}
+
+	tests := []struct {
+		tag, want string
+	}{
+		{"hatsune_miku", "hatsune_miku"},
+		{"miku_hatsune", "hatsune_miku"},
+		{"miku", "hatsune_miku"},
+		{"self", "self"},
+		{"a", "a"},
+		{"b", "a"},
+		{"x", "x"},
+		{"y", "x"},
+		{"z", "x"},
+		{"w", "x"},
+		{"c0", "c8"},
+	}
+
+	for _, tt := range tests {
+		if got := m.Alias(tt.tag); got != tt.want {
+			t.Errorf("Alias(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+
+	var nilMap *TagMap
+	if got := nilMap.Alias("miku"); got != "miku" {
+		t.Errorf("nil Alias(%q) = %q, want it unchanged", "miku", got)
+	}
+}
+
+func TestTagMapNormalize(t *testing.T) {
+	m := &TagMap{
+		Aliases: map[string]string{
+			"miku_hatsune":      "hatsune_miku",
+			"vocaloid_(series)": "vocaloid",
+			"a":                 "b",
+			"b":                 "a",
+		},
+		Implications: map[string][]string{
+			// Implied tags which are aliases are renamed, and their own
+			// implications followed
+			"hatsune_miku": {"vocaloid_(series)"},
+			"vocaloid":     {"music"},
+			"kagamine_rin": {"kagamine_len"},
+			"kagamine_len": {"kagamine_rin"},
+			"a":            {"c"},
+		},
+	}
+
+	tests := []struct {
+		tags, want string
+	}{
+		{"miku_hatsune", "hatsune_miku vocaloid music"},
+		{"hatsune_miku miku_hatsune vocaloid", "hatsune_miku vocaloid music"},
+		{"kagamine_rin", "kagamine_rin kagamine_len"},
+		{"a b", "a c"},
+		{"b", "a c"},
+		{"other", "other"},
+	}
+
+	for _, tt := range tests {
+		if got := strings.Join(m.Normalize(strings.Fields(tt.tags)), " "); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package booru
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// TagLimit is the most tags returned when searching for them.
+	TagLimit = 10
+
+	// tagTTL is how long tags looked up by name are remembered for.
+	tagTTL = time.Hour
+
+	// maxCachedTags is how many tags a tagCache remembers at most.
+	maxCachedTags = 100000
+)
+
+// Tag is a tag found by searching for it.
+type Tag struct {
+	// Name is the name of the tag, as it is used in searches.
+	Name string `json:"name"`
+
+	// Count is the number of posts with this tag.
+	Count int `json:"count"`
+
+	// Category is the category of the tag.
+	Category TagCategory `json:"category"`
+}
+
+// Tagger is implemented by APIs that can search for tags.
+// Every API with CapAutocomplete implements it.
+type Tagger interface {
+	// Tags returns up to TagLimit tags starting with prefix, most used first.
+	Tags(ctx context.Context, prefix string) ([]Tag, error)
+}
+
+// TagLooker is implemented by APIs that can look up tags by name.
+// Every API with CapTagCounts implements it.
+type TagLooker interface {
+	// LookupTags returns the tags with the given names, along with how many
+	// posts have them.
+	// Tags the booru doesn't know about are left out.
+	LookupTags(ctx context.Context, names []string) ([]Tag, error)
+}
+
+// tagCache remembers tags looked up by name for a while, including the ones
+// that weren't found.
+//
+// The zero-value is usable.
+type tagCache struct {
+	m map[string]tagEntry
+	sync.Mutex
+}
+
+type tagEntry struct {
+	tag   Tag
+	known bool
+	t     time.Time
+}
+
+func (c *tagCache) get(name string) (tagEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.m[name]
+	if !ok || time.Since(e.t) > tagTTL {
+		return tagEntry{}, false
+	}
+
+	return e, true
+}
+
+func (c *tagCache) put(name string, e tagEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.m == nil {
+		c.m = map[string]tagEntry{}
+	}
+
+	if len(c.m) >= maxCachedTags {
+		// Clean out old entries, or everything if that isn't enough
+		for k, v := range c.m {
+			if time.Since(v.t) > tagTTL {
+				delete(c.m, k)
+			}
+		}
+
+		if len(c.m) >= maxCachedTags {
+			c.m = map[string]tagEntry{}
+		}
+	}
+
+	e.t = time.Now()
+	c.m[name] = e
+}
+
+// lookupTags returns the tags with the given names from c, using fetch to
+// look up the ones it doesn't have, at most chunk at a time.
+func lookupTags(ctx context.Context, c *tagCache, names []string, chunk int, fetch func(context.Context, []string) ([]Tag, error)) ([]Tag, error) {
+	var missing []string
+	for _, v := range names {
+		if _, ok := c.get(v); !ok {
+			missing = append(missing, v)
+		}
+	}
+
+	for i := 0; i < len(missing); i += chunk {
+		end := i + chunk
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		found, err := fetch(ctx, missing[i:end])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range found {
+			c.put(v.Name, tagEntry{tag: v, known: true})
+		}
+
+		// Remember the ones that weren't found too, so they aren't asked
+		// for again
+		for _, v := range missing[i:end] {
+			if _, ok := c.get(v); !ok {
+				c.put(v, tagEntry{})
+			}
+		}
+	}
+
+	out := make([]Tag, 0, len(names))
+	for _, v := range names {
+		if e, ok := c.get(v); ok && e.known {
+			out = append(out, e.tag)
+		}
+	}
+
+	return out, nil
+}
+
+// tagTypes maps the numbers Danbooru and Gelbooru use for tag categories to
+// categories.
+// Anything else, such as deprecated tags, is general.
+var tagTypes = map[int]TagCategory{
+	1: CategoryArtist,
+	3: CategoryCopyright,
+	4: CategoryCharacter,
+	5: CategoryMeta,
+}
@@ -0,0 +1,487 @@
+package booru
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TermKind describes what a Term represents.
+type TermKind int
+
+const (
+	// TermTag is a plain tag, or anything that isn't understood well enough
+	// to be translated; these are passed through as is.
+	TermTag TermKind = iota
+
+	// TermOr matches if any of its sub-terms match.
+	TermOr
+
+	// TermRating matches any of the ratings it holds.
+	TermRating
+
+	// TermOrder changes the order results are returned in.
+	TermOrder
+
+	// TermScore compares the score of a post against a number.
+	TermScore
+
+	// TermID compares the ID of a post against a number.
+	TermID
+
+	// TermDate compares the date a post was created against a date, written
+	// as YYYY-MM-DD.
+	TermDate
+
+	// TermAnd matches if all of its sub-terms match.
+	// It is only found inside TermOr, where a range can't be split into two
+	// terms.
+	TermAnd
+)
+
+// Term is a single search term in a form that is independent of any booru's
+// syntax.
+//
+// Terms are created using ParseTags, and are translated into the syntax of a
+// specific booru by the booru itself.
+type Term struct {
+	Kind TermKind
+
+	// Negate inverts the meaning of this term.
+	Negate bool
+
+	// Value is the tag for TermTag, the key to sort by for TermOrder, or the
+	// value being compared against for TermScore, TermID, and TermDate.
+	Value string
+
+	// Op is the comparison operator used by TermScore, TermID, and TermDate;
+	// one of "=", "<", "<=", ">", or ">=".
+	// For TermOrder, it is either "asc" or "desc".
+	Op string
+
+	// Ratings holds the ratings matched by TermRating.
+	Ratings []Rating
+
+	// Any holds the sub-terms of TermOr and TermAnd.
+	Any []Term
+}
+
+// Translator is implemented by APIs that translate queries into their own
+// syntax.
+type Translator interface {
+	// Translate renders a query into the tags that would be sent to the
+	// booru.
+	// Terms that cannot be expressed are left out, and returned separately
+	// so they may be reported to the user.
+	Translate(q Query) (tags []string, unsupported []Term)
+}
+
+// dialect renders neutral terms into the syntax of a specific booru.
+type dialect interface {
+	// render renders a single term, returning false if it can't be
+	// expressed.
+	// Some terms expand to several tags.
+	render(t Term) ([]string, bool)
+}
+
+// ratingNames maps every accepted way to write a rating to the rating itself.
+var ratingNames = map[string]Rating{
+	"general":      General,
+	"g":            General,
+	"safe":         General,
+	"questionable": Questionable,
+	"q":            Questionable,
+	"sensitive":    Sensitive,
+	"s":            Sensitive,
+	"explicit":     Explicit,
+	"e":            Explicit,
+}
+
+// orderNames maps the names boorus use for sorting to a neutral key.
+var orderNames = map[string]string{
+	"id":             "id",
+	"score":          "score",
+	"updated":        "updated",
+	"change":         "updated",
+	"random":         "random",
+	"width":          "width",
+	"height":         "height",
+	"favcount":       "favorites",
+	"favorites":      "favorites",
+	"filesize":       "filesize",
+	"mpixels":        "mpixels",
+	"comment":        "comments",
+	"comment_bumped": "comments",
+	"comments":       "comments",
+}
+
+// compareNames maps kinds of comparisons to the name of their metatag.
+var compareNames = map[TermKind]string{
+	TermScore: "score",
+	TermID:    "id",
+	TermDate:  "date",
+}
+
+// ParseTags parses a list of tags written in the syntax of any supported booru
+// into neutral terms.
+//
+// The following are understood:
+//
+//	tag, -tag                 plain tags
+//	~a ~b                     a or b
+//	{a ~ b}                   a or b, Gelbooru style
+//	a or b, ( a or b )        a or b, Danbooru style
+//	rating:g,s  rating:safe   ratings, using any known name
+//	order:score_asc           Danbooru ordering
+//	sort:score:asc            Gelbooru ordering
+//	score:>10  score:1..5     score comparisons and ranges
+//	id:<100                   ID comparisons
+//	date:>=2020-01-01         date comparisons
+//
+// Anything else is kept as a plain tag.
+func ParseTags(tags []string) []Term {
+	p := tagParser{}
+	for _, v := range tags {
+		if v != "" {
+			p.toks = append(p.toks, v)
+		}
+	}
+
+	return p.parse()
+}
+
+type tagParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *tagParser) next() (string, bool) {
+	if p.pos >= len(p.toks) {
+		return "", false
+	}
+	p.pos++
+	return p.toks[p.pos-1], true
+}
+
+func (p *tagParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *tagParser) parse() []Term {
+	var out []Term
+	var tilde []Term
+
+	for {
+		tok, ok := p.next()
+		if !ok {
+			break
+		}
+
+		var t []Term
+		switch {
+		case tok == "(" || tok == "-(":
+			g := p.group(")", "or")
+			g.Negate = tok[0] == '-'
+			t = []Term{g}
+		case strings.HasPrefix(tok, "{") || strings.HasPrefix(tok, "-{"):
+			// Only the first "-" negates the group; one after the brace
+			// belongs to the first term in it
+			neg := strings.HasPrefix(tok, "-")
+			p.pos--
+			p.toks[p.pos] = strings.TrimPrefix(strings.TrimPrefix(tok, "-"), "{")
+			g := p.group("}", "~")
+			g.Negate = neg
+			t = []Term{g}
+		case strings.HasPrefix(tok, "~") && len(tok) > 1:
+			tilde = append(tilde, alternative(tok[1:]))
+			continue
+		default:
+			t = parseTerm(tok)
+		}
+
+		// Infix or binds to the previous term
+		if p.peek() == "or" {
+			g := Term{Kind: TermOr, Any: []Term{and(t)}}
+			for p.peek() == "or" {
+				p.next()
+				tok, ok := p.next()
+				if !ok {
+					break
+				}
+				g.Any = append(g.Any, alternative(tok))
+			}
+			t = []Term{g}
+		}
+
+		out = append(out, t...)
+	}
+
+	if len(tilde) > 0 {
+		out = append(out, Term{Kind: TermOr, Any: tilde})
+	}
+
+	return out
+}
+
+// group reads terms until end is found, ignoring separators.
+// Closing characters attached to the last term are also accepted.
+func (p *tagParser) group(end, sep string) Term {
+	g := Term{Kind: TermOr}
+
+	for {
+		tok, ok := p.next()
+		if !ok || tok == end {
+			break
+		}
+
+		last := false
+		if end == "}" && strings.HasSuffix(tok, end) {
+			tok = strings.TrimSuffix(tok, end)
+			last = true
+		}
+
+		if sep == "~" {
+			tok = strings.TrimPrefix(tok, sep)
+		}
+
+		if tok != "" && tok != sep {
+			g.Any = append(g.Any, alternative(tok))
+		}
+
+		if last {
+			break
+		}
+	}
+
+	return g
+}
+
+// alternative parses a single tag that is one of the alternatives of TermOr.
+func alternative(tok string) Term {
+	return and(parseTerm(tok))
+}
+
+// and combines terms into one, which matches if all of them match.
+// A range has to stay together this way, as its halves would otherwise become
+// separate alternatives.
+func and(t []Term) Term {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return Term{Kind: TermAnd, Any: t}
+}
+
+// parseTerm parses a single tag.
+// Ranges expand to two terms, which is why a slice is returned.
+func parseTerm(tok string) []Term {
+	t := Term{Kind: TermTag, Value: tok}
+
+	if strings.HasPrefix(tok, "-") && len(tok) > 1 {
+		t.Negate = true
+		tok = tok[1:]
+		t.Value = tok
+	}
+
+	name, val, ok := strings.Cut(tok, ":")
+	if !ok {
+		return []Term{t}
+	}
+
+	switch name {
+	case "rating":
+		var rs []Rating
+		for _, v := range strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == '|' }) {
+			r, ok := ratingNames[strings.ToLower(v)]
+			if !ok {
+				return []Term{t}
+			}
+			rs = append(rs, r)
+		}
+
+		if len(rs) == 0 {
+			break
+		}
+
+		t.Kind = TermRating
+		t.Ratings = rs
+		t.Value = ""
+	case "order", "sort":
+		key, dir := val, ""
+		if name == "order" {
+			if strings.HasSuffix(val, "_asc") {
+				key, dir = strings.TrimSuffix(val, "_asc"), "asc"
+			} else if strings.HasSuffix(val, "_desc") {
+				key, dir = strings.TrimSuffix(val, "_desc"), "desc"
+			} else if key == "id" {
+				// Danbooru sorts by ID in ascending order; everything
+				// else is descending by default
+				dir = "asc"
+			}
+		} else {
+			key, dir, _ = strings.Cut(val, ":")
+		}
+
+		k, ok := orderNames[key]
+		if !ok || (dir != "" && dir != "asc" && dir != "desc") {
+			break
+		}
+
+		if dir == "" {
+			dir = "desc"
+		}
+
+		t.Kind = TermOrder
+		t.Value = k
+		t.Op = dir
+	case "score", "id", "date":
+		kind := map[string]TermKind{"score": TermScore, "id": TermID, "date": TermDate}[name]
+		valid := func(v string) bool {
+			if kind == TermDate {
+				_, err := time.Parse("2006-01-02", v)
+				return err == nil
+			}
+			_, err := strconv.Atoi(v)
+			return err == nil
+		}
+
+		if lo, hi, ok := strings.Cut(val, ".."); ok {
+			// A negated range can't be split into two terms
+			if t.Negate || !valid(lo) || !valid(hi) {
+				break
+			}
+
+			return []Term{
+				{Kind: kind, Op: ">=", Value: lo},
+				{Kind: kind, Op: "<=", Value: hi},
+			}
+		}
+
+		op := "="
+		for _, o := range []string{"<=", ">=", "<", ">", "="} {
+			if strings.HasPrefix(val, o) {
+				op, val = o, strings.TrimPrefix(val, o)
+				break
+			}
+		}
+
+		if !valid(val) {
+			break
+		}
+
+		t.Kind = kind
+		t.Op = op
+		t.Value = val
+	}
+
+	return []Term{t}
+}
+
+// String returns the term in a booru-neutral form, similar to Danbooru's
+// syntax.
+func (t Term) String() string {
+	s := ""
+	if t.Negate {
+		s = "-"
+	}
+
+	switch t.Kind {
+	case TermOr:
+		ss := make([]string, len(t.Any))
+		for i, v := range t.Any {
+			ss[i] = v.String()
+		}
+		return fmt.Sprintf("%s(%s)", s, strings.Join(ss, " or "))
+	case TermAnd:
+		ss := make([]string, len(t.Any))
+		for i, v := range t.Any {
+			ss[i] = v.String()
+		}
+		return fmt.Sprintf("%s(%s)", s, strings.Join(ss, " "))
+	case TermRating:
+		ss := make([]string, len(t.Ratings))
+		for i, v := range t.Ratings {
+			ss[i] = strings.ToLower(v.String())
+		}
+		return fmt.Sprintf("%srating:%s", s, strings.Join(ss, ","))
+	case TermOrder:
+		return fmt.Sprintf("%sorder:%s_%s", s, t.Value, t.Op)
+	case TermScore, TermID, TermDate:
+		op := t.Op
+		if op == "=" {
+			op = ""
+		}
+		return fmt.Sprintf("%s%s:%s%s", s, compareNames[t.Kind], op, t.Value)
+	}
+
+	return s + t.Value
+}
+
+// terms converts a query into neutral terms, including the structured fields
+// with the exception of the ID cursors.
+func (q Query) terms() []Term {
+	t := ParseTags(q.Tags)
+
+	if q.Order != "" {
+		key, dir := q.Order, "desc"
+		if strings.HasSuffix(key, "_asc") {
+			key, dir = strings.TrimSuffix(key, "_asc"), "asc"
+		}
+
+		// Unknown keys are kept so they can be reported
+		if k, ok := orderNames[key]; ok {
+			key = k
+		}
+		t = append(t, Term{Kind: TermOrder, Value: key, Op: dir})
+	}
+
+	if len(q.Ratings) > 0 {
+		t = append(t, Term{Kind: TermRating, Ratings: q.Ratings})
+	}
+
+	if q.MinScore != nil {
+		t = append(t, Term{Kind: TermScore, Op: ">=", Value: strconv.Itoa(*q.MinScore)})
+	}
+
+	if !q.After.IsZero() {
+		t = append(t, Term{Kind: TermDate, Op: ">=", Value: q.After.Format("2006-01-02")})
+	}
+
+	if !q.Before.IsZero() {
+		t = append(t, Term{Kind: TermDate, Op: "<", Value: q.Before.Format("2006-01-02")})
+	}
+
+	return t
+}
+
+// translate renders terms using a dialect, separating out the terms that
+// can't be expressed.
+func translate(d dialect, terms []Term) ([]string, []Term) {
+	var tags []string
+	var bad []Term
+
+	for _, t := range terms {
+		r, ok := d.render(t)
+		if !ok {
+			bad = append(bad, t)
+			continue
+		}
+
+		tags = append(tags, r...)
+	}
+
+	return tags, bad
+}
+
+// Translate translates a query using b if it is a Translator, otherwise the
+// tags are returned untouched.
+func Translate(b API, q Query) ([]string, []Term) {
+	if t, ok := b.(Translator); ok {
+		return t.Translate(q)
+	}
+
+	return q.Tags, nil
+}
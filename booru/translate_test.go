@@ -0,0 +1,82 @@
+package booru
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"touhou -comic", []string{"touhou", "-comic"}},
+		{"{a ~ b}", []string{"(a or b)"}},
+		{"{-a ~ b}", []string{"(-a or b)"}},
+		{"-{a ~ b}", []string{"-(a or b)"}},
+		{"-{-a ~ b}", []string{"-(-a or b)"}},
+		{"{-a ~ -b} c", []string{"(-a or -b)", "c"}},
+		{"~a ~b c", []string{"c", "(a or b)"}},
+		{"a or b", []string{"(a or b)"}},
+		{"-( a or b )", []string{"-(a or b)"}},
+		{"score:1..5", []string{"score:>=1", "score:<=5"}},
+		{"~score:1..5 ~touhou", []string{"((score:>=1 score:<=5) or touhou)"}},
+		{"score:1..5 or touhou", []string{"((score:>=1 score:<=5) or touhou)"}},
+		{"touhou or score:1..5", []string{"(touhou or (score:>=1 score:<=5))"}},
+		{"{score:1..5 ~ touhou}", []string{"((score:>=1 score:<=5) or touhou)"}},
+		{"rating:s,e", []string{"rating:sensitive,explicit"}},
+		{"order:score_asc", []string{"order:score_asc"}},
+		{"sort:score:asc", []string{"order:score_asc"}},
+		{"-score:1..5", []string{"-score:1..5"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, v := range ParseTags(strings.Fields(tt.in)) {
+			got = append(got, v.String())
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		in       string
+		danbooru []string
+		gelbooru []string
+
+		// gelbooruBad is the number of terms Gelbooru can't express.
+		gelbooruBad int
+	}{
+		{"touhou -comic", []string{"touhou", "-comic"}, []string{"touhou", "-comic"}, 0},
+		{"{a ~ b}", []string{"(a or b)"}, []string{"{a ~ b}"}, 0},
+		{"{-a ~ b}", []string{"(-a or b)"}, []string{"{-a ~ b}"}, 0},
+		{"-{a ~ b}", []string{"-(a or b)"}, []string{"-a", "-b"}, 0},
+		{"-( a or b )", []string{"-(a or b)"}, []string{"-a", "-b"}, 0},
+		{"score:1..5", []string{"score:>=1", "score:<=5"}, []string{"score:>=1", "score:<=5"}, 0},
+		{"~score:1..5 ~touhou", []string{"((score:>=1 score:<=5) or touhou)"}, nil, 1},
+		{"score:1..5 or touhou", []string{"((score:>=1 score:<=5) or touhou)"}, nil, 1},
+		{"~rating:s ~rating:e", []string{"(rating:s or rating:e)"}, []string{"{rating:sensitive ~ rating:explicit}"}, 0},
+		{"score:>3", []string{"score:>3"}, []string{"score:>=4"}, 0},
+		{"-score:<3", []string{"-score:<3"}, []string{"score:>=3"}, 0},
+		{"date:>=2020-01-01", []string{"date:>=2020-01-01"}, nil, 1},
+	}
+
+	for _, tt := range tests {
+		q := Query{Tags: strings.Fields(tt.in)}
+
+		got, bad := (&danbooru{}).Translate(q)
+		if !reflect.DeepEqual(got, tt.danbooru) || len(bad) != 0 {
+			t.Errorf("danbooru: Translate(%q) = %q, %v; want %q", tt.in, got, bad, tt.danbooru)
+		}
+
+		got, bad = (&gelbooru{}).Translate(q)
+		if !reflect.DeepEqual(got, tt.gelbooru) || len(bad) != tt.gelbooruBad {
+			t.Errorf("gelbooru: Translate(%q) = %q, %v; want %q with %d unsupported", tt.in, got, bad, tt.gelbooru, tt.gelbooruBad)
+		}
+	}
+}
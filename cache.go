@@ -0,0 +1,69 @@
+package boorumux
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	// defaultCacheSize is the size of the media cache if it isn't set.
+	defaultCacheSize = 64 << 20
+)
+
+// mediaCache is an in-memory cache of media we made ourselves, such as resized
+// images.
+// Once it holds more than max bytes, the least recently used entries are
+// thrown out.
+type mediaCache struct {
+	max  int64
+	size int64
+	ll   *list.List
+	m    map[string]*list.Element
+	sync.Mutex
+}
+
+// mediaEntry is a file in a mediaCache.
+type mediaEntry struct {
+	key  string
+	mime string
+	data []byte
+}
+
+func (c *mediaCache) get(k string) (mediaEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.m[k]
+	if !ok {
+		return mediaEntry{}, false
+	}
+
+	c.ll.MoveToFront(e)
+	return e.Value.(mediaEntry), true
+}
+
+func (c *mediaCache) put(k, mime string, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.m == nil {
+		c.m = map[string]*list.Element{}
+		c.ll = list.New()
+	}
+
+	if e, ok := c.m[k]; ok {
+		c.size -= int64(len(e.Value.(mediaEntry).data))
+		c.ll.Remove(e)
+	}
+
+	c.m[k] = c.ll.PushFront(mediaEntry{key: k, mime: mime, data: data})
+	c.size += int64(len(data))
+
+	for c.size > c.max && c.ll.Len() > 1 {
+		e := c.ll.Back()
+		me := e.Value.(mediaEntry)
+		c.size -= int64(len(me.data))
+		delete(c.m, me.key)
+		c.ll.Remove(e)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/KushBlazingJudah/boorumux/filter"
+)
+
+// importCmd implements "boorumux import", which merges a blacklist exported
+// from a booru account into boorumux.json.
+func importCmd(args []string) {
+	fl := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fl.String("format", "danbooru", "Syntax of the blacklist; danbooru, e621, or gelbooru.")
+	source := fl.String("source", "", "Add to the blacklist of this source instead of the global one.")
+	dry := fl.Bool("n", false, "Print what would be added without saving anything.")
+	fl.Usage = func() {
+		fmt.Fprintf(fl.Output(), "usage: %s import [flags] file\n\nReads from standard input if file is \"-\".\n\n", os.Args[0])
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+
+	if fl.NArg() != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	fm, ok := filter.Formats[*format]
+	if !ok {
+		log.Fatalf("unknown format \"%s\"", *format)
+	}
+
+	var r io.Reader = os.Stdin
+	if fl.Arg(0) != "-" {
+		f, err := os.Open(fl.Arg(0))
+		if err != nil {
+			log.Fatalf("failed opening blacklist: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	fs, bad, err := filter.Import(r, fm)
+	if err != nil {
+		log.Fatalf("failed reading blacklist: %v", err)
+	}
+
+	for _, v := range bad {
+		log.Printf("skipped %v", v)
+	}
+
+	// The config is handled loosely so nothing we don't know about is lost
+	c := map[string]interface{}{}
+	b, err := os.ReadFile("./boorumux.json")
+	if err != nil {
+		log.Fatalf("failed opening config: %v", err)
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil {
+		log.Fatalf("failed reading config: %v", err)
+	}
+
+	target := c
+	if *source != "" {
+		srcs, _ := c["sources"].(map[string]interface{})
+		target, ok = srcs[*source].(map[string]interface{})
+		if !ok {
+			log.Fatalf("no source named \"%s\"", *source)
+		}
+	}
+
+	list, added := mergeBlacklist(target["blacklist"], fs)
+	target["blacklist"] = list
+
+	for _, v := range added {
+		fmt.Println(v)
+	}
+
+	log.Printf("%d filters added, %d already present, %d lines skipped", len(added), len(fs)-len(added), len(bad))
+
+	if *dry || len(added) == 0 {
+		return
+	}
+
+	if err := saveConfig("./boorumux.json", c); err != nil {
+		log.Fatalf("failed saving config: %v", err)
+	}
+}
+
+// saveConfig writes the config to name.
+// It is written to a temporary file first, which then replaces name, so the
+// config isn't lost if anything goes wrong part of the way through.
+func saveConfig(name string, c map[string]interface{}) error {
+	h, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(h.Name())
+
+	// Filters are full of "<" and ">", which shouldn't be escaped
+	enc := json.NewEncoder(h)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(c); err != nil {
+		h.Close()
+		return err
+	}
+
+	if err := h.Close(); err != nil {
+		return err
+	}
+
+	// Keep the permissions of the old file, as it may hold passwords
+	if fi, err := os.Stat(name); err == nil {
+		if err := os.Chmod(h.Name(), fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(h.Name(), name)
+}
+
+// mergeBlacklist adds filters to a blacklist as it appears in the config,
+// skipping those which are already in it.
+// The blacklist is converted into a list if it isn't one already.
+func mergeBlacklist(bl interface{}, fs []filter.Filter) ([]interface{}, []string) {
+	var list []interface{}
+	switch v := bl.(type) {
+	case []interface{}:
+		list = v
+	case nil:
+	default:
+		list = []interface{}{v}
+	}
+
+	seen := map[string]struct{}{}
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			seen[s] = struct{}{}
+		}
+	}
+
+	var added []string
+	for _, f := range fs {
+		s := f.String()
+		if _, ok := seen[s]; ok {
+			continue
+		}
+
+		seen[s] = struct{}{}
+		list = append(list, s)
+		added = append(added, s)
+	}
+
+	return list, added
+}
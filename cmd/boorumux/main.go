@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -17,16 +18,42 @@ import (
 )
 
 var (
-	Prefix = flag.String("prefix", "", "Root path of the server. (unimplemented)")
-	Listen = flag.String("addr", "localhost:8080", "Listening address of the HTTP server.")
+	Prefix  = flag.String("prefix", "", "Root path of the server. (unimplemented)")
+	Listen  = flag.String("addr", "localhost:8080", "Listening address of the HTTP server.")
+	Refetch = flag.Bool("refetch-tags", false, "Download the tag map again, even if it has been saved.")
 )
 
 var proxyFn func(*http.Request) (*url.URL, error) = nil
 
 type cfg struct {
-	Proxy     string                 `json:"proxy"`
-	Sources   map[string]interface{} `json:"sources"`
-	Blacklist interface{}            `json:"blacklist"`
+	Proxy          string                 `json:"proxy"`
+	Sources        map[string]interface{} `json:"sources"`
+	Blacklist      interface{}            `json:"blacklist"`
+	PostBlacklist  string                 `json:"post_blacklist,omitempty"`
+	Highlight      interface{}            `json:"highlight,omitempty"`
+	HighlightFirst bool                   `json:"highlight_first,omitempty"`
+	Tags           *tagsCfg               `json:"tags,omitempty"`
+	Secret         string                 `json:"secret,omitempty"`
+	ResizeQuality  int                    `json:"resize_quality,omitempty"`
+	CacheSize      int64                  `json:"cache_size,omitempty"`
+}
+
+// tagsCfg describes where the tag map comes from.
+type tagsCfg struct {
+	// File is where the tag map is loaded from, and saved to if fetched.
+	File string `json:"file"`
+
+	// Fetch is the URL of a Danbooru instance to download aliases and
+	// implications from, if File doesn't exist yet.
+	Fetch string `json:"fetch,omitempty"`
+}
+
+// blacklistModes maps the values of post_blacklist to what they mean.
+var blacklistModes = map[string]boorumux.BlacklistMode{
+	"":      boorumux.BlacklistWarn,
+	"warn":  boorumux.BlacklistWarn,
+	"off":   boorumux.BlacklistOff,
+	"block": boorumux.BlacklistBlock,
 }
 
 func mkDefaults() {
@@ -34,13 +61,15 @@ func mkDefaults() {
 
 	d := cfg{
 		Sources: map[string]interface{}{
-			"gelbooru": map[string]string{
-				"type": "gelbooru",
-				"url":  "https://gelbooru.com",
+			"gelbooru": map[string]interface{}{
+				"type":  "gelbooru",
+				"url":   "https://gelbooru.com",
+				"hosts": []string{"*.gelbooru.com"},
 			},
-			"safebooru": map[string]string{
-				"type": "danbooru",
-				"url":  "https://safebooru.donmai.us",
+			"safebooru": map[string]interface{}{
+				"type":  "danbooru",
+				"url":   "https://safebooru.donmai.us",
+				"hosts": []string{"*.donmai.us"},
 			},
 			"examplemux": map[string]interface{}{
 				"type":    "mux",
@@ -90,18 +119,61 @@ func genBooru(name string, b map[string]interface{}, c cfg) booru.API {
 	}
 
 	b["http"] = ht
+	b["name"] = name
 
 	B, err := booru.New(b["type"].(string), b)
 	if err != nil {
 		log.Fatalf("error initializing booru \"%s\": %v", name, err)
 	}
 
+	// Subdomains used to be trusted without being listed, so older configs
+	// don't have this even though most boorus need it
+	if hosts := booru.HostsOf(B); hosts != nil && b["hosts"] == nil {
+		log.Printf("booru \"%s\" has no \"hosts\", so only files on %s are shown; if its images don't load, see \"Media proxy\" in the README", name, hosts[0])
+	}
+
 	return B
 }
 
+func loadTags(tc *tagsCfg) *booru.TagMap {
+	if !*Refetch || tc.Fetch == "" {
+		m, err := booru.LoadTagMap(tc.File)
+		if err == nil {
+			log.Printf("Loaded %d aliases and %d implications from %s", len(m.Aliases), len(m.Implications), tc.File)
+			return m
+		} else if !errors.Is(err, fs.ErrNotExist) || tc.Fetch == "" {
+			log.Fatalf("failed loading tag map: %v", err)
+		}
+	}
+
+	log.Printf("Fetching tag map from %s; this may take a while", tc.Fetch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	m, err := booru.FetchTagMap(ctx, &http.Client{Transport: &http.Transport{Proxy: proxyFn}}, tc.Fetch, boorumux.UserAgent)
+	if err != nil {
+		log.Fatalf("failed fetching tag map: %v", err)
+	}
+
+	if tc.File != "" {
+		if err := m.Save(tc.File); err != nil {
+			log.Fatalf("failed saving tag map: %v", err)
+		}
+	}
+
+	log.Printf("Fetched %d aliases and %d implications", len(m.Aliases), len(m.Implications))
+	return m
+}
+
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "import" {
+		importCmd(flag.Args()[1:])
+		return
+	}
+
 	bm := &boorumux.Server{
 		Prefix: *Prefix,
 	}
@@ -137,13 +209,55 @@ func main() {
 		proxyFn = http.ProxyURL(pu)
 	}
 
+	if c.Tags != nil {
+		bm.Tags = loadTags(c.Tags)
+	}
+
+	if c.Secret != "" {
+		bm.Secret = []byte(c.Secret)
+	} else {
+		log.Printf("No secret is set; links to media will stop working when Boorumux restarts")
+	}
+
+	bm.ResizeQuality = c.ResizeQuality
+	bm.CacheSize = c.CacheSize << 20
+
 	bm.Boorus = map[string]booru.API{}
-	bm.Blacklist = filter.ParseMany(c.Blacklist)
+	bm.Blacklist, err = filter.ParseMany(c.Blacklist)
+	if err != nil {
+		log.Fatalf("failed parsing blacklist: %v", err)
+	}
 
+	bm.Highlight, err = filter.ParseMany(c.Highlight)
+	if err != nil {
+		log.Fatalf("failed parsing highlight: %v", err)
+	}
+	bm.HighlightFirst = c.HighlightFirst
+
+	mode, ok := blacklistModes[c.PostBlacklist]
+	if !ok {
+		log.Fatalf("unknown post_blacklist \"%s\"; must be off, warn, or block", c.PostBlacklist)
+	}
+	bm.PostBlacklist = mode
+
+	bm.Blacklists = map[string]boorumux.SourceBlacklist{}
 	muxes := map[string]map[string]interface{}{}
 
 	for k, v := range c.Sources {
 		vv := v.(map[string]interface{})
+
+		if vv["blacklist"] != nil {
+			fs, err := filter.ParseMany(vv["blacklist"])
+			if err != nil {
+				log.Fatalf("failed parsing blacklist for \"%s\": %v", k, err)
+			}
+
+			bm.Blacklists[k] = boorumux.SourceBlacklist{
+				Filters:  fs,
+				Override: vv["blacklist_mode"] == "override",
+			}
+		}
+
 		if vv["type"] == "mux" {
 			muxes[k] = vv
 			continue
@@ -161,7 +275,7 @@ func main() {
 			if b, ok := bm.Boorus[vv.(string)]; ok {
 				m = append(m, b)
 			} else {
-				log.Fatal("for mux \"%s\": booru \"%s\" not found", k, vv)
+				log.Fatalf("for mux \"%s\": booru \"%s\" not found", k, vv)
 			}
 		}
 
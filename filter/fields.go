@@ -0,0 +1,192 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// numField is a numeric property of a post that can be compared.
+type numField struct {
+	// get returns the value of the field, and false if it is unknown, in
+	// which case the post never matches.
+	get func(p *booru.Post) (float64, bool)
+
+	// parse parses the value being compared against.
+	parse func(v string) (float64, error)
+}
+
+// numFields are the numeric fields of a post that can be compared.
+var numFields = map[string]numField{
+	"score": {
+		get:   func(p *booru.Post) (float64, bool) { return float64(p.Score), true },
+		parse: parseNum,
+	},
+	"id": {
+		get:   func(p *booru.Post) (float64, bool) { return float64(p.Id), true },
+		parse: parseNum,
+	},
+	"width": {
+		get:   func(p *booru.Post) (float64, bool) { return known(p.Original.Width) },
+		parse: parseNum,
+	},
+	"height": {
+		get:   func(p *booru.Post) (float64, bool) { return known(p.Original.Height) },
+		parse: parseNum,
+	},
+	"tagcount": {
+		get:   func(p *booru.Post) (float64, bool) { return float64(len(p.Tags)), true },
+		parse: parseNum,
+	},
+	"size": {
+		get:   func(p *booru.Post) (float64, bool) { return known(p.Original.Size) },
+		parse: parseSize,
+	},
+	"age": {
+		get: func(p *booru.Post) (float64, bool) {
+			if p.Created.IsZero() {
+				return 0, false
+			}
+			return time.Since(p.Created).Seconds(), true
+		},
+		parse: parseAge,
+	},
+	"ratio": {
+		get: func(p *booru.Post) (float64, bool) {
+			if p.Original.Width == 0 || p.Original.Height == 0 {
+				return 0, false
+			}
+			return float64(p.Original.Width) / float64(p.Original.Height), true
+		},
+		parse: parseRatio,
+	},
+}
+
+// strFields are the text fields of a post that can be matched against a
+// pattern.
+var strFields = map[string]func(p *booru.Post) string{
+	"mime":   func(p *booru.Post) string { return p.Original.MIME },
+	"ext":    postExt,
+	"source": func(p *booru.Post) string { return p.Source },
+	"booru":  func(p *booru.Post) string { return booru.NameOf(p.Origin) },
+}
+
+// sizeUnits are the units accepted by size:, in bytes.
+var sizeUnits = []struct {
+	suffix string
+	n      float64
+}{
+	{"gb", 1024 * 1024 * 1024},
+	{"mb", 1024 * 1024},
+	{"kb", 1024},
+	{"g", 1024 * 1024 * 1024},
+	{"m", 1024 * 1024},
+	{"k", 1024},
+	{"b", 1},
+}
+
+// ageUnits are the units accepted by age:, in seconds.
+// These are the same as the ones Danbooru uses.
+var ageUnits = []struct {
+	suffix string
+	n      float64
+}{
+	{"mi", 60},
+	{"mo", 60 * 60 * 24 * 30},
+	{"s", 1},
+	{"h", 60 * 60},
+	{"d", 60 * 60 * 24},
+	{"w", 60 * 60 * 24 * 7},
+	{"y", 60 * 60 * 24 * 365},
+}
+
+func known(n int) (float64, bool) {
+	return float64(n), n != 0
+}
+
+func parseNum(v string) (float64, error) {
+	return strconv.ParseFloat(v, 64)
+}
+
+// parseSize parses a file size such as "20MB".
+func parseSize(v string) (float64, error) {
+	lv := strings.ToLower(v)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(lv, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(lv, u.suffix), 64)
+			return n * u.n, err
+		}
+	}
+
+	return strconv.ParseFloat(lv, 64)
+}
+
+// parseAge parses an age such as "5y" into seconds.
+func parseAge(v string) (float64, error) {
+	lv := strings.ToLower(v)
+	for _, u := range ageUnits {
+		if strings.HasSuffix(lv, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(lv, u.suffix), 64)
+			return n * u.n, err
+		}
+	}
+
+	return 0, fmt.Errorf("missing unit")
+}
+
+// parseRatio parses an aspect ratio, written either as "16:9" or "1.78".
+func parseRatio(v string) (float64, error) {
+	a, b, ok := strings.Cut(v, ":")
+	if !ok {
+		return strconv.ParseFloat(v, 64)
+	}
+
+	w, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	h, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if h == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+
+	return w / h, nil
+}
+
+// postExt finds the file extension of a post, without the dot.
+func postExt(p *booru.Post) string {
+	e := strings.ToLower(strings.TrimPrefix(path.Ext(p.Original.Href), "."))
+	if i := strings.IndexAny(e, "?#"); i >= 0 {
+		e = e[:i]
+	}
+
+	if e == "jpeg" {
+		return "jpg"
+	}
+	return e
+}
+
+// compileGlob compiles a list of alternative patterns, where "*" matches
+// anything and "?" matches any single character, into a regular expression.
+// Matching is case insensitive.
+func compileGlob(pats []string) *regexp.Regexp {
+	ss := make([]string, len(pats))
+	for i, v := range pats {
+		v = regexp.QuoteMeta(v)
+		v = strings.ReplaceAll(v, `\*`, ".*")
+		v = strings.ReplaceAll(v, `\?`, ".")
+		ss[i] = v
+	}
+
+	return regexp.MustCompile(`(?is)^(?:` + strings.Join(ss, "|") + `)$`)
+}
@@ -0,0 +1,264 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// Format is the blacklist syntax used by a booru's account settings.
+type Format int
+
+const (
+	// FormatDanbooru is Danbooru's blacklist: one rule per line, where every
+	// tag must match, "-tag" excludes a tag, and "~tag" makes a tag one of
+	// several alternatives.
+	FormatDanbooru Format = iota
+
+	// FormatE621 is e621's blacklist, which is like Danbooru's except that
+	// "rating:s" means safe rather than sensitive.
+	FormatE621
+
+	// FormatGelbooru is Gelbooru's blacklist, where every tag separated by
+	// spaces or newlines is its own rule.
+	FormatGelbooru
+)
+
+// Formats maps the names of blacklist formats to the format itself.
+var Formats = map[string]Format{
+	"danbooru": FormatDanbooru,
+	"e621":     FormatE621,
+	"gelbooru": FormatGelbooru,
+}
+
+// ImportError describes a line of a blacklist that couldn't be imported.
+type ImportError struct {
+	// Line is the line number, starting from 1.
+	Line int
+
+	// Text is the line as it was written.
+	Text string
+
+	// Msg describes why it couldn't be imported.
+	Msg string
+}
+
+// importFields maps metatags used by boorus to the fields they translate to.
+var importFields = map[string]string{
+	"score":    "score",
+	"id":       "id",
+	"width":    "width",
+	"height":   "height",
+	"tagcount": "tagcount",
+	"filesize": "size",
+	"ratio":    "ratio",
+	"age":      "age",
+	"source":   "source",
+	"filetype": "ext",
+	"type":     "ext",
+	"ext":      "ext",
+}
+
+// importUnsupported are metatags which can't be expressed as a filter, because
+// they depend on information boorus don't give us.
+var importUnsupported = map[string]struct{}{
+	"user":          {},
+	"fav":           {},
+	"favgroup":      {},
+	"favcount":      {},
+	"pool":          {},
+	"status":        {},
+	"parent":        {},
+	"child":         {},
+	"approver":      {},
+	"uploader":      {},
+	"commenter":     {},
+	"comment_count": {},
+	"noter":         {},
+	"order":         {},
+	"md5":           {},
+	"pixiv_id":      {},
+	"is":            {},
+	"has":           {},
+	"locked":        {},
+	"set":           {},
+	"upvote":        {},
+	"downvote":      {},
+	"artcomm":       {},
+	"mpixels":       {},
+	"duration":      {},
+	"date":          {},
+	"limit":         {},
+	"sort":          {},
+	"ordfav":        {},
+	"ordpool":       {},
+	"random":        {},
+	"search":        {},
+	"note_count":    {},
+	"commentary":    {},
+	"flagger":       {},
+	"appealer":      {},
+	"disapproved":   {},
+	"embedded":      {},
+}
+
+// e621Ratings maps e621's rating letters, which differ from Danbooru's, to
+// their names.
+var e621Ratings = map[string]string{
+	"s": "general",
+	"q": "questionable",
+	"e": "explicit",
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("line %d: %q: %s", e.Line, e.Text, e.Msg)
+}
+
+// Import reads a blacklist written in the syntax of a booru's account
+// settings, and converts it into filters.
+//
+// Rules which can't be translated are left out and returned as ImportErrors,
+// so they can be reported.
+// The error is only set if reading failed.
+func Import(r io.Reader, format Format) ([]Filter, []ImportError, error) {
+	var fs []Filter
+	var bad []ImportError
+
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rules := [][]string{strings.Fields(text)}
+		if format == FormatGelbooru {
+			rules = rules[:0]
+			for _, v := range strings.Fields(text) {
+				rules = append(rules, []string{v})
+			}
+		}
+
+		for _, rule := range rules {
+			// Gelbooru has no way of combining tags, so a negated tag
+			// here is a rule of its own, which would hide nearly
+			// everything
+			if format == FormatGelbooru && strings.HasPrefix(rule[0], "-") && len(rule[0]) > 1 {
+				bad = append(bad, ImportError{Line: line, Text: rule[0], Msg: "a negated tag on its own would hide almost every post"})
+				continue
+			}
+
+			f, err := importRule(rule, format)
+			if err != nil {
+				bad = append(bad, ImportError{Line: line, Text: strings.Join(rule, " "), Msg: err.Error()})
+				continue
+			}
+			fs = append(fs, f)
+		}
+	}
+
+	return fs, bad, sc.Err()
+}
+
+// importRule translates one rule, made up of tags which must all match.
+func importRule(tags []string, format Format) (Filter, error) {
+	var all, some []string
+
+	for _, t := range tags {
+		neg, alt := false, false
+		if strings.HasPrefix(t, "-") && len(t) > 1 {
+			neg, t = true, t[1:]
+		} else if strings.HasPrefix(t, "~") && len(t) > 1 {
+			alt, t = true, t[1:]
+		}
+
+		s, err := importTerm(t, format)
+		if err != nil {
+			return Filter{}, err
+		}
+
+		switch {
+		case neg:
+			all = append(all, "-"+s)
+		case alt:
+			some = append(some, s)
+		default:
+			all = append(all, s)
+		}
+	}
+
+	if len(some) == 1 {
+		all = append(all, some[0])
+	} else if len(some) > 1 {
+		all = append(all, "("+strings.Join(some, " or ")+")")
+	}
+
+	return Parse(strings.Join(all, " "))
+}
+
+// importTerm translates a single tag or metatag.
+func importTerm(t string, format Format) (string, error) {
+	key, val, ok := strings.Cut(t, ":")
+	if !ok || val == "" {
+		return quoteTag(t), nil
+	}
+
+	key = strings.ToLower(key)
+
+	if key == "rating" {
+		var rs []string
+		for _, r := range strings.Split(strings.ToLower(val), ",") {
+			if n, ok := e621Ratings[r]; ok && format == FormatE621 {
+				r = n
+			}
+			if _, ok := ratingNames[r]; !ok {
+				return "", fmt.Errorf("unknown rating %q", r)
+			}
+			rs = append(rs, r)
+		}
+		return "rating:" + strings.Join(rs, "|"), nil
+	}
+
+	if f, ok := importFields[key]; ok {
+		// Danbooru allows several values separated by commas in some
+		// places, which are alternatives
+		return f + ":" + strings.ReplaceAll(val, ",", "|"), nil
+	}
+
+	if _, ok := importUnsupported[key]; ok {
+		return "", fmt.Errorf("%q can't be used in filters", key+":")
+	}
+
+	if _, ok := booru.ParseCategory(key); ok {
+		// "*" means the same thing here, but anything else that means
+		// something in a filter would be read differently
+		if strings.ContainsAny(val, `()"\?|:`) {
+			return "", fmt.Errorf("%q can't be translated", t)
+		}
+		return key + ":" + val, nil
+	}
+
+	// Anything else is a tag that happens to have a colon in it, such as
+	// "re:zero"
+	return quoteTag(t), nil
+}
+
+// quoteTag quotes a tag if it would otherwise be read as something other than
+// a plain tag.
+func quoteTag(t string) string {
+	switch strings.ToLower(t) {
+	case "and", "or", "not":
+		return `"` + t + `"`
+	}
+
+	if !strings.ContainsAny(t, `()"\*?|:`) && !isRegexp(t) {
+		return t
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(t) + `"`
+}
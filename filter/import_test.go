@@ -0,0 +1,61 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		format Format
+		src    string
+		want   []string
+		bad    int
+	}{
+		{FormatDanbooru, "guro\nlucky_star -chibi\n~a ~b rating:e,q", []string{"guro", "lucky_star -chibi", "rating:e|q (a or b)"}, 0},
+		{FormatDanbooru, "score:<0 filetype:gif,webm", []string{"score:<0 ext:gif|webm"}, 0},
+		{FormatDanbooru, "artist:foo :o", []string{`artist:foo ":o"`}, 0},
+		{FormatDanbooru, "artist:foo*bar", []string{"artist:foo*bar"}, 0},
+		{FormatDanbooru, "re:zero_kara_hajimeru_isekai_seikatsu", []string{`"re:zero_kara_hajimeru_isekai_seikatsu"`}, 0},
+		{FormatDanbooru, "mahou_shoujo_madoka_magica:_hangyaku_no_monogatari", []string{`"mahou_shoujo_madoka_magica:_hangyaku_no_monogatari"`}, 0},
+		{FormatDanbooru, "guro date:>2020-01-01\npool:123\nfoo user:bar", nil, 3},
+		{FormatE621, "rating:s", []string{"rating:general"}, 0},
+		{FormatGelbooru, "guro -loli scat", []string{"guro", "scat"}, 1},
+	}
+
+	for _, tt := range tests {
+		fs, bad, err := Import(strings.NewReader(tt.src), tt.format)
+		if err != nil {
+			t.Fatalf("Import(%q): %v", tt.src, err)
+		}
+
+		var got []string
+		for _, f := range fs {
+			got = append(got, f.String())
+		}
+
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") || len(bad) != tt.bad {
+			t.Errorf("Import(%q) = %q with %d skipped, want %q with %d skipped", tt.src, got, len(bad), tt.want, tt.bad)
+		}
+	}
+}
+
+func TestImportColonTags(t *testing.T) {
+	post := &booru.Post{Tags: []string{"re:zero_kara_hajimeru_isekai_seikatsu", "mahou_shoujo_madoka_magica:_hangyaku_no_monogatari"}}
+
+	for _, tag := range post.Tags {
+		fs, bad, err := Import(strings.NewReader(tag), FormatDanbooru)
+		if err != nil || len(bad) != 0 || len(fs) != 1 {
+			t.Fatalf("Import(%q) = %v, %v, %v", tag, fs, bad, err)
+		}
+
+		if !fs[0].Match(post) {
+			t.Errorf("Import(%q) = %q, which doesn't match the tag", tag, fs[0].String())
+		}
+		if fs[0].Match(&booru.Post{Tags: []string{"zero"}}) {
+			t.Errorf("Import(%q) = %q, which matches other tags", tag, fs[0].String())
+		}
+	}
+}
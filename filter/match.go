@@ -1,39 +1,129 @@
 package filter
 
 import (
+	"math"
+	"regexp"
 	"strings"
 
 	"github.com/KushBlazingJudah/boorumux/booru"
 )
 
-func matchRating(c string, p *booru.Post) bool {
-	for _, r := range strings.Split(c, "|") {
-		var rr booru.Rating
-		switch r {
-		default:
-			fallthrough
-		case "general", "safe", "g", "sfw":
-			rr = booru.General
-		case "questionable", "q":
-			rr = booru.Questionable
-		case "sensitive", "s":
-			rr = booru.Sensitive
-		case "explicit", "e":
-			rr = booru.Explicit
-		}
-
-		if p.Rating == rr {
+// node is a part of a parsed filter.
+type node interface {
+	match(t *target) bool
+}
+
+// andNode matches if all of its nodes match.
+type andNode []node
+
+// orNode matches if any of its nodes match.
+type orNode []node
+
+// notNode matches if its node doesn't.
+type notNode struct {
+	n node
+}
+
+// tagNode matches if a post has any of these tags, or any tag matching one of
+// the patterns.
+type tagNode struct {
+	tags []string
+	pats []*regexp.Regexp
+}
+
+// catNode matches if a post has a tag in a category matching tags.
+type catNode struct {
+	cat  booru.TagCategory
+	tags tagNode
+}
+
+// ratingNode matches if a post has any of these ratings.
+type ratingNode []booru.Rating
+
+// cmpNode compares a number taken from a post.
+type cmpNode struct {
+	field numField
+	op    string
+	v     float64
+}
+
+// globNode matches text taken from a post against a pattern.
+type globNode struct {
+	field func(p *booru.Post) string
+	re    *regexp.Regexp
+}
+
+var ratingNames = map[string]booru.Rating{
+	"general":      booru.General,
+	"safe":         booru.General,
+	"g":            booru.General,
+	"sfw":          booru.General,
+	"questionable": booru.Questionable,
+	"q":            booru.Questionable,
+	"sensitive":    booru.Sensitive,
+	"s":            booru.Sensitive,
+	"explicit":     booru.Explicit,
+	"e":            booru.Explicit,
+}
+
+func (n andNode) match(t *target) bool {
+	for _, v := range n {
+		if !v.match(t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n orNode) match(t *target) bool {
+	for _, v := range n {
+		if v.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n notNode) match(t *target) bool {
+	return !n.n.match(t)
+}
+
+func (n tagNode) match(t *target) bool {
+	for _, v := range n.tags {
+		if t.has(v) {
 			return true
 		}
 	}
 
+	if len(n.pats) == 0 {
+		return false
+	}
+
+	for _, v := range t.p.Tags {
+		for _, re := range n.pats {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+
 	return false
 }
 
-func matchTag(ts string, p *booru.Post) bool {
-	for _, t := range strings.Split(ts, "|") {
-		for _, v := range p.Tags {
-			if v == string(t) {
+func (n catNode) match(t *target) bool {
+	for _, v := range t.p.Tags {
+		if t.p.Category(v) != n.cat {
+			continue
+		}
+
+		for _, tag := range n.tags.tags {
+			if v == tag {
+				return true
+			}
+		}
+
+		for _, re := range n.tags.pats {
+			if re.MatchString(v) {
 				return true
 			}
 		}
@@ -42,33 +132,196 @@ func matchTag(ts string, p *booru.Post) bool {
 	return false
 }
 
-func (f Filter) Match(p *booru.Post) bool {
-	for _, v := range f {
-		neg := strings.HasPrefix(v, "-")
-		if neg {
-			v = strings.TrimPrefix(v, "-")
+func (n ratingNode) match(t *target) bool {
+	for _, r := range n {
+		if t.p.Rating == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n cmpNode) match(t *target) bool {
+	v, ok := n.field.get(t.p)
+	return ok && compare(v, n.op, n.v)
+}
+
+func (n globNode) match(t *target) bool {
+	return n.re.MatchString(n.field(t.p))
+}
+
+func compare(a float64, op string, b float64) bool {
+	// Close enough is good enough for equality, mostly for the sake of
+	// aspect ratios
+	const epsilon = 0.01
+
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "!=":
+		return math.Abs(a-b) >= epsilon
+	}
+	return math.Abs(a-b) < epsilon
+}
+
+// cutOp splits a comparison operator from the start of a value.
+// If there is none, "=" is returned.
+func cutOp(v string) (string, string) {
+	for _, o := range []string{"<=", ">=", "!=", "<", ">", "="} {
+		if strings.HasPrefix(v, o) {
+			return o, strings.TrimPrefix(v, o)
 		}
+	}
+	return "=", v
+}
 
-		var res bool
+// parseTerm parses a single tag or metatag found at pos.
+func (p *parser) parseTerm(t string, pos int) (node, error) {
+	key, val, ok := strings.Cut(t, ":")
+	if !ok || isRegexp(t) {
+		return p.parseTags(t, pos)
+	}
 
-		if strings.HasPrefix(v, "rating:") {
-			r := strings.TrimPrefix(v, "rating:")
-			res = matchRating(r, p)
-			goto check
+	if key == "rating" {
+		var n ratingNode
+		for _, r := range strings.Split(val, "|") {
+			rr, ok := ratingNames[strings.ToLower(r)]
+			if !ok {
+				// Older versions accepted anything here, so unknown
+				// ratings are left as tags rather than refusing to start
+				return p.parseTags(t, pos)
+			}
+			n = append(n, rr)
 		}
+		return n, nil
+	}
 
-		// Just match against the tags
-		res = matchTag(v, p)
+	if c, ok := booru.ParseCategory(key); ok {
+		n, err := p.parseTags(val, pos)
+		if err != nil {
+			return nil, err
+		}
+		return catNode{c, n.(tagNode)}, nil
+	}
 
-	check:
-		if neg {
-			res = !res
+	if f, ok := numFields[key]; ok {
+		if lo, hi, ok := strings.Cut(val, ".."); ok {
+			a, err := f.parse(lo)
+			if err != nil {
+				return nil, p.errorf(pos, "invalid %s %q", key, lo)
+			}
+			b, err := f.parse(hi)
+			if err != nil {
+				return nil, p.errorf(pos, "invalid %s %q", key, hi)
+			}
+			return andNode{cmpNode{f, ">=", a}, cmpNode{f, "<=", b}}, nil
 		}
 
-		if !res {
-			return false
+		op, v := cutOp(val)
+		n, err := f.parse(v)
+		if err != nil {
+			return nil, p.errorf(pos, "invalid %s %q", key, v)
 		}
+		return cmpNode{f, op, n}, nil
 	}
 
-	return true
+	if f, ok := strFields[key]; ok {
+		return globNode{f, compileGlob(strings.Split(val, "|"))}, nil
+	}
+
+	// Anything else is just a tag that happens to have a colon in it
+	return p.parseTags(t, pos)
+}
+
+// parseTags parses a list of alternative tags separated by "|".
+// Tags containing "*" or "?" are treated as patterns.
+// If it is surrounded by "/", it is a regular expression instead, which may use
+// "|" itself.
+func (p *parser) parseTags(t string, pos int) (node, error) {
+	n := tagNode{}
+
+	if isRegexp(t) {
+		re, err := regexp.Compile(t[1 : len(t)-1])
+		if err != nil {
+			return nil, p.errorf(pos, "invalid regular expression: %v", err)
+		}
+		n.pats = append(n.pats, re)
+		return n, nil
+	}
+
+	var globs []string
+	for _, v := range strings.Split(t, "|") {
+		if strings.ContainsAny(v, "*?") {
+			globs = append(globs, v)
+		} else {
+			n.tags = append(n.tags, v)
+		}
+	}
+
+	if len(globs) > 0 {
+		n.pats = append(n.pats, compileGlob(globs))
+	}
+
+	return n, nil
+}
+
+// isRegexp reports whether t is a regular expression, written as "/.../".
+// Unlike a prefix such as "re:", tags practically never look like this.
+func isRegexp(t string) bool {
+	return len(t) > 2 && t[0] == '/' && t[len(t)-1] == '/'
+}
+
+// Match reports whether a post matches this filter.
+func (f Filter) Match(p *booru.Post) bool {
+	if f.root == nil {
+		return false
+	}
+	return f.root.match(&target{p: p})
+}
+
+// Alias returns a copy of the filter with each tag it matches literally
+// renamed by fn, so it can be matched against posts whose tags have been
+// renamed the same way.
+// Patterns are left alone.
+func (f Filter) Alias(fn func(string) string) Filter {
+	if f.root != nil {
+		f.root = alias(f.root, fn)
+	}
+	return f
+}
+
+func alias(n node, fn func(string) string) node {
+	switch v := n.(type) {
+	case andNode:
+		out := make(andNode, len(v))
+		for i, c := range v {
+			out[i] = alias(c, fn)
+		}
+		return out
+	case orNode:
+		out := make(orNode, len(v))
+		for i, c := range v {
+			out[i] = alias(c, fn)
+		}
+		return out
+	case notNode:
+		return notNode{alias(v.n, fn)}
+	case tagNode:
+		tags := make([]string, len(v.tags))
+		for i, t := range v.tags {
+			tags[i] = fn(t)
+		}
+		return tagNode{tags: tags, pats: v.pats}
+	case catNode:
+		return catNode{cat: v.cat, tags: alias(v.tags, fn).(tagNode)}
+	}
+
+	return n
 }
@@ -3,35 +3,443 @@ package filter
 import (
 	"fmt"
 	"strings"
+	"unicode"
 )
 
-type Filter []string
+// Filter is a parsed filter expression, which can be matched against posts.
+type Filter struct {
+	src  string
+	root node
+}
+
+// SyntaxError is returned when a filter can't be parsed.
+type SyntaxError struct {
+	// Filter is the filter being parsed.
+	Filter string
+
+	// Pos is the byte offset into Filter where the problem was found.
+	Pos int
+
+	// Msg describes what went wrong.
+	Msg string
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokQuoted
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind tokKind
+	val  string
+	pos  int
+}
+
+type parser struct {
+	src  string
+	toks []token
+	i    int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter: %q at position %d: %s", e.Filter, e.Pos, e.Msg)
+}
+
+// lex splits a filter into tokens.
+//
+// Parentheses are only treated as such when they aren't part of a tag, so
+// tags like "izumi_konata_(cosplay)", "(o)_(o)", or ":)" work as expected:
+//
+//   - "(" opens a group when it starts a word, unless the word goes on after
+//     its matching ")"
+//   - ")" closes a group when it stands alone, or when it ends a word and
+//     wasn't opened in it and a group is open
+//
+// Anything else is part of a tag.
+func lex(src string) ([]token, error) {
+	var toks []token
+	open := 0
+
+	i := 0
+	for i < len(src) {
+		c := src[i]
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+			continue
+		case c == '(' && opensGroup(src, i):
+			toks = append(toks, token{kind: tokLParen, pos: i})
+			open++
+			i++
+			continue
+		case c == ')' && (open > 0 || i+1 == len(src) || unicode.IsSpace(rune(src[i+1])) || src[i+1] == ')'):
+			toks = append(toks, token{kind: tokRParen, pos: i})
+			if open > 0 {
+				open--
+			}
+			i++
+			continue
+		case c == '-' && i+1 < len(src) && (src[i+1] == '"' || (src[i+1] == '(' && opensGroup(src, i+1))):
+			toks = append(toks, token{kind: tokNot, pos: i})
+			i++
+			continue
+		}
+
+		start := i
+		kind := tokWord
+		if c == '"' {
+			kind = tokQuoted
+		}
+
+		sb := strings.Builder{}
+		depth := 0
+
+		// closing holds the positions of the parentheses at the end of the
+		// word which weren't opened in it, as they may close groups instead
+		var closing []int
+
+	word:
+		for i < len(src) {
+			c := src[i]
+
+			switch {
+			case unicode.IsSpace(rune(c)):
+				break word
+			case c == '"':
+				// Quoted sections are copied verbatim
+				end := i + 1
+				for end < len(src) && src[end] != '"' {
+					if src[end] == '\\' && end+1 < len(src) {
+						end++
+					}
+					end++
+				}
+
+				if end >= len(src) {
+					return nil, &SyntaxError{Filter: src, Pos: i, Msg: "unterminated quote"}
+				}
+
+				sb.WriteString(unescape(src[i+1 : end]))
+				closing = closing[:0]
+				i = end + 1
+				continue
+			case c == '(':
+				depth++
+				closing = closing[:0]
+			case c == ')':
+				if depth == 0 {
+					closing = append(closing, sb.Len())
+				} else {
+					depth--
+					closing = closing[:0]
+				}
+			default:
+				closing = closing[:0]
+			}
+
+			sb.WriteByte(c)
+			i++
+		}
+
+		// Only as many as there are open groups are taken off the end
+		val := sb.String()
+		n := len(closing)
+		if n > open {
+			n = open
+		}
+		var parens []token
+		if n > 0 {
+			cut := closing[len(closing)-n]
+			for j := 0; j < n; j++ {
+				parens = append(parens, token{kind: tokRParen, pos: i - n + j})
+			}
+			val = val[:cut]
+			open -= n
+		}
+
+		if val != "" || kind == tokQuoted {
+			t := token{kind: kind, val: val, pos: start}
+			if kind == tokWord {
+				switch strings.ToLower(t.val) {
+				case "and", "&&":
+					t.kind = tokAnd
+				case "or", "||":
+					t.kind = tokOr
+				case "not":
+					t.kind = tokNot
+				}
+			}
 
-func Parse(f string) Filter {
-	return Filter(strings.Split(f, " "))
+			toks = append(toks, t)
+		}
+
+		toks = append(toks, parens...)
+	}
+
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
 }
 
-func ParseMany(t interface{}) []Filter {
+// opensGroup reports whether the "(" at i opens a group, rather than being
+// part of a tag such as "(o)_(o)".
+func opensGroup(src string, i int) bool {
+	depth := 0
+	for j := i; j < len(src) && !unicode.IsSpace(rune(src[j])); j++ {
+		switch src[j] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				// The word carrying on means it's a tag
+				return j+1 == len(src) || unicode.IsSpace(rune(src[j+1])) || src[j+1] == ')'
+			}
+		}
+	}
+
+	return true
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(pos int, f string, args ...interface{}) error {
+	return &SyntaxError{Filter: p.src, Pos: pos, Msg: fmt.Sprintf(f, args...)}
+}
+
+// parseOr parses terms separated by "or", which binds the loosest.
+func (p *parser) parseOr() (node, error) {
+	n, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	ns := orNode{n}
+	for p.peek().kind == tokOr {
+		p.next()
+
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+
+	if len(ns) == 1 {
+		return ns[0], nil
+	}
+	return ns, nil
+}
+
+// parseAnd parses terms separated by "and", or simply placed next to each
+// other.
+func (p *parser) parseAnd() (node, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	ns := andNode{n}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokWord, tokQuoted, tokLParen, tokNot:
+		default:
+			if len(ns) == 1 {
+				return ns[0], nil
+			}
+			return ns, nil
+		}
+
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokNot:
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	case tokLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if e := p.next(); e.kind != tokRParen {
+			return nil, p.errorf(t.pos, "missing closing parenthesis")
+		}
+		return n, nil
+	case tokQuoted:
+		return tagNode{tags: []string{t.val}}, nil
+	case tokWord:
+		if strings.HasPrefix(t.val, "-") && len(t.val) > 1 {
+			n, err := p.parseTerm(t.val[1:], t.pos+1)
+			if err != nil {
+				return nil, err
+			}
+			return notNode{n}, nil
+		}
+
+		return p.parseTerm(t.val, t.pos)
+	case tokRParen:
+		return nil, p.errorf(t.pos, "unexpected closing parenthesis")
+	case tokEOF:
+		return nil, p.errorf(t.pos, "expected a tag")
+	}
+
+	return nil, p.errorf(t.pos, "unexpected %q", t.val)
+}
+
+// Parse parses a filter.
+//
+// Tags placed next to each other must all match.
+// Expressions can be combined using "and", "or", and "not", and grouped with
+// parentheses.
+// A tag can be negated by placing a "-" in front of it, and several
+// alternatives can be given by separating them with a "|".
+// Tags may be patterns using "*" and "?", or regular expressions surrounded by
+// "/"; both are compiled here so matching stays fast.
+// Quoted tags are always taken literally.
+// An empty filter is accepted, but never matches anything.
+func Parse(f string) (Filter, error) {
+	// An empty filter never matches anything
+	if strings.TrimSpace(f) == "" {
+		return Filter{src: f}, nil
+	}
+
+	toks, err := lex(f)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	p := parser{src: f, toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return Filter{}, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return Filter{}, p.errorf(t.pos, "unexpected closing parenthesis")
+	}
+
+	return Filter{src: f, root: n}, nil
+}
+
+// ParseMany parses a list of filters as it appears in the configuration file,
+// which may be a string, a list, or a map where the key applies to everything
+// inside of it.
+func ParseMany(t interface{}) ([]Filter, error) {
 	switch e := t.(type) {
 	case map[string]interface{}:
 		ret := []Filter{}
 		for base, v := range e {
-			f := ParseMany(v)
+			b, err := Parse(base)
+			if err != nil {
+				return nil, err
+			}
+
+			f, err := ParseMany(v)
+			if err != nil {
+				return nil, err
+			}
+
 			for _, ff := range f {
-				ret = append(ret, append([]string{base}, ff...))
+				ret = append(ret, b.and(ff))
 			}
 		}
-		return ret
+		return ret, nil
 	case []interface{}:
 		ret := []Filter{}
 		for _, v := range e {
-			f := ParseMany(v)
+			f, err := ParseMany(v)
+			if err != nil {
+				return nil, err
+			}
 			ret = append(ret, f...)
 		}
-		return ret
+		return ret, nil
 	case string:
-		return []Filter{Parse(e)}
+		f, err := Parse(e)
+		if err != nil {
+			return nil, err
+		}
+		return []Filter{f}, nil
+	case nil:
+		return nil, nil
 	default:
-		panic(fmt.Sprintf("filter.ParseMany: unknown type \"%T\"", t))
+		return nil, fmt.Errorf("filter: unknown type \"%T\"", t)
+	}
+}
+
+// and combines two filters so that both must match.
+func (f Filter) and(o Filter) Filter {
+	// An empty key in a map doesn't narrow down anything, but an empty
+	// filter inside of one still never matches
+	if f.root == nil {
+		return o
+	} else if o.root == nil {
+		return Filter{src: f.src}
 	}
+
+	return Filter{
+		src:  f.wrapped() + " " + o.wrapped(),
+		root: andNode{f.root, o.root},
+	}
+}
+
+// wrapped returns the source of the filter, in parentheses if it wouldn't
+// combine with other filters correctly otherwise.
+func (f Filter) wrapped() string {
+	if _, ok := f.root.(orNode); ok {
+		return "(" + f.src + ")"
+	}
+	return f.src
+}
+
+// String returns the source of the filter.
+func (f Filter) String() string {
+	return f.src
 }
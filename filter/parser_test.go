@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+func TestParse(t *testing.T) {
+	post := &booru.Post{
+		Tags:   []string{":)", ";)", "(o)_(o)", "izumi_konata_(cosplay)", "touhou", "or", "re:zero_kara_hajimeru_isekai_seikatsu"},
+		Rating: booru.Explicit,
+	}
+
+	tests := []struct {
+		f    string
+		want bool
+	}{
+		{":)", true},
+		{";)", true},
+		{":) ;)", true},
+		{"(o)_(o)", true},
+		{"-(o)_(o)", false},
+		{"izumi_konata_(cosplay)", true},
+		{"(izumi_konata_(cosplay))", true},
+		{"(touhou or vocaloid) and :)", true},
+		{"(vocaloid or :))", true},
+		{"(vocaloid or (o)_(o))", true},
+		{"-(touhou or vocaloid)", false},
+		{"not (vocaloid)", true},
+		{"re:zero_kara_hajimeru_isekai_seikatsu", true},
+		{"re:zero", false},
+		{"re:touhou", false},
+		{"/^izumi_konata_/", true},
+		{"/^(touhou|vocaloid)$/", true},
+		{"/^zero/", false},
+		{`"or"`, true},
+		{`-"or"`, false},
+		{"rating:e", true},
+		{"rating:nsfw", false},
+		{"", false},
+		{"   ", false},
+		{`""`, false},
+	}
+
+	for _, tt := range tests {
+		f, err := Parse(tt.f)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.f, err)
+			continue
+		}
+
+		if got := f.Match(post); got != tt.want {
+			t.Errorf("Parse(%q).Match() = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	post := &booru.Post{
+		Tags:       []string{"hatsune_miku", "vocaloid"},
+		Categories: map[string]booru.TagCategory{"hatsune_miku": booru.CategoryCharacter},
+	}
+	m := &booru.TagMap{Aliases: map[string]string{"miku_hatsune": "hatsune_miku"}}
+
+	tests := []struct {
+		f    string
+		want bool
+	}{
+		{"miku_hatsune", true},
+		{"-miku_hatsune", false},
+		{"miku_hatsune|kagamine_rin", true},
+		{"character:miku_hatsune", true},
+		{"not (miku_hatsune or vocaloid)", false},
+		{"miku_*", false},
+	}
+
+	for _, tt := range tests {
+		f, err := Parse(tt.f)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.f, err)
+		}
+
+		if got := f.Alias(m.Alias).Match(post); got != tt.want {
+			t.Errorf("Parse(%q).Alias().Match() = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, f := range []string{"(touhou", "touhou )", `"touhou`, "a or", "score:>x", "/(/"} {
+		if _, err := Parse(f); err == nil {
+			t.Errorf("Parse(%q) succeeded, expected an error", f)
+		}
+	}
+}
+
+// TestParseMany checks that blacklists written for older versions, in every
+// form the configuration file allows, still load and match the same posts.
+func TestParseMany(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		hide []bool
+	}{
+		{"string", `"touhou :)"`, []bool{true, false, false, false}},
+		{"list", `["(o)_(o)", ";)", "", "rating:nsfw", null]`, []bool{false, true, true, false}},
+		{"map", `{"rating:e": ["touhou", "(o)_(o)"], "": [":)"]}`, []bool{true, true, false, true}},
+		{"nested", `{"touhou": {"rating:e": [":)", ""]}}`, []bool{true, false, false, false}},
+	}
+
+	posts := []*booru.Post{
+		{Tags: []string{"touhou", ":)"}, Rating: booru.Explicit},
+		{Tags: []string{"(o)_(o)", ";)"}, Rating: booru.Explicit},
+		{Tags: []string{"vocaloid", ";)"}, Rating: booru.General},
+		{Tags: []string{"touhou"}, Rating: booru.Explicit},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.json), &v); err != nil {
+			t.Fatal(err)
+		}
+
+		fs, err := ParseMany(v)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		set := Compile(fs)
+		for i, p := range posts {
+			if _, got := set.Match(p); got != tt.hide[i] {
+				t.Errorf("%s: post %d hidden = %v, want %v", tt.name, i, got, tt.hide[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package filter
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// Set is a list of filters compiled so that large lists can be matched
+// against many posts quickly.
+//
+// Each filter is indexed by the rarest tag it requires, so only the filters
+// that could possibly match a post are checked.
+// Filters that don't require any specific tag are always checked.
+type Set struct {
+	filters []Filter
+	index   map[string][]int
+	always  []int
+
+	// categories is set if any filter depends on the categories of tags.
+	categories bool
+}
+
+// target is a post being matched, along with anything worth computing only
+// once per post.
+type target struct {
+	p *booru.Post
+
+	// tags is the set of tags on the post.
+	// If nil, the tags are searched through one by one instead.
+	tags map[string]struct{}
+}
+
+var tagSetPool = sync.Pool{
+	New: func() any {
+		return map[string]struct{}{}
+	},
+}
+
+func (t *target) has(tag string) bool {
+	if t.tags != nil {
+		_, ok := t.tags[tag]
+		return ok
+	}
+
+	for _, v := range t.p.Tags {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// required finds the tags that a post must have for a node to match.
+func required(n node) []string {
+	switch v := n.(type) {
+	case tagNode:
+		if len(v.tags) == 1 && len(v.pats) == 0 {
+			return v.tags
+		}
+	case catNode:
+		return required(v.tags)
+	case andNode:
+		var out []string
+		for _, c := range v {
+			out = append(out, required(c)...)
+		}
+		return out
+	}
+
+	// Anything else could match without a specific tag
+	return nil
+}
+
+// usesCategories reports whether a node depends on the categories of tags.
+func usesCategories(n node) bool {
+	switch v := n.(type) {
+	case catNode:
+		return true
+	case andNode:
+		for _, c := range v {
+			if usesCategories(c) {
+				return true
+			}
+		}
+	case orNode:
+		for _, c := range v {
+			if usesCategories(c) {
+				return true
+			}
+		}
+	case notNode:
+		return usesCategories(v.n)
+	}
+
+	return false
+}
+
+// Compile compiles a list of filters into a Set.
+func Compile(fs []Filter) *Set {
+	s := &Set{
+		filters: fs,
+		index:   map[string][]int{},
+	}
+
+	// Find out how common each required tag is, so each filter can be put
+	// under the least common one
+	reqs := make([][]string, len(fs))
+	freq := map[string]int{}
+	for i, f := range fs {
+		if f.root == nil {
+			continue
+		}
+
+		s.categories = s.categories || usesCategories(f.root)
+		reqs[i] = required(f.root)
+		for _, t := range reqs[i] {
+			freq[t]++
+		}
+	}
+
+	for i, r := range reqs {
+		if fs[i].root == nil {
+			continue
+		}
+
+		if len(r) == 0 {
+			s.always = append(s.always, i)
+			continue
+		}
+
+		best := r[0]
+		for _, t := range r[1:] {
+			if freq[t] < freq[best] {
+				best = t
+			}
+		}
+		s.index[best] = append(s.index[best], i)
+	}
+
+	return s
+}
+
+// Len returns the number of filters in the set.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.filters)
+}
+
+// UsesCategories reports whether any filter in the set depends on the
+// categories of tags, which some boorus have to look up separately.
+func (s *Set) UsesCategories() bool {
+	return s != nil && s.categories
+}
+
+// Match finds the first filter, in the order they were given, that matches a
+// post.
+func (s *Set) Match(p *booru.Post) (Filter, bool) {
+	if s.Len() == 0 {
+		return Filter{}, false
+	}
+
+	tags := tagSetPool.Get().(map[string]struct{})
+	defer tagSetPool.Put(tags)
+	defer func() {
+		for k := range tags {
+			delete(tags, k)
+		}
+	}()
+
+	for _, v := range p.Tags {
+		tags[v] = struct{}{}
+	}
+
+	t := &target{p: p, tags: tags}
+
+	// Collect the indexed filters that could match; the ones that are
+	// always checked are already in order, so they are merged in as they're
+	// needed rather than sorted along with them, which matters when there
+	// are a lot of them
+	var cand []int
+	for _, v := range p.Tags {
+		cand = append(cand, s.index[v]...)
+	}
+	sort.Ints(cand)
+
+	i, j := 0, 0
+	for i < len(cand) || j < len(s.always) {
+		var c int
+		if j >= len(s.always) || (i < len(cand) && cand[i] < s.always[j]) {
+			c = cand[i]
+			i++
+
+			// Filters are indexed under one tag, but posts can repeat them
+			if i > 1 && cand[i-2] == c {
+				continue
+			}
+		} else {
+			c = s.always[j]
+			j++
+		}
+
+		if s.filters[c].root.match(t) {
+			return s.filters[c], true
+		}
+	}
+
+	return Filter{}, false
+}
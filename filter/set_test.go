@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// randomFilters makes n filters using the first kinds of terms below, along
+// with posts to match them against.
+// The first five are what a typical blacklist looks like, and can all be
+// indexed; the rest can't always be.
+func randomFilters(n, tags, kinds int) ([]Filter, []booru.Post) {
+	r := rand.New(rand.NewSource(1))
+	tag := func() string { return fmt.Sprintf("tag%d", r.Intn(tags)) }
+
+	var fs []Filter
+	for i := 0; i < n; i++ {
+		var s string
+		switch i % kinds {
+		case 0:
+			s = tag()
+		case 1:
+			s = tag() + " -" + tag()
+		case 2:
+			s = "rating:e " + tag()
+		case 3:
+			s = fmt.Sprintf("(%s or %s) %s", tag(), tag(), fmt.Sprintf("tag%d", r.Intn(50)))
+		case 4:
+			s = fmt.Sprintf("score:<%d %s", r.Intn(5), tag())
+		case 5:
+			s = fmt.Sprintf("tag%d* %s", r.Intn(10), tag())
+		case 6:
+			s = "artist:" + tag()
+		case 7:
+			s = fmt.Sprintf("character:tag%d*", r.Intn(100))
+		case 8:
+			s = fmt.Sprintf("not (%s or %s) width:>%d", tag(), tag(), r.Intn(2000))
+		case 9:
+			s = fmt.Sprintf("%s|%s age:<%dd", tag(), tag(), r.Intn(30))
+		}
+
+		f, err := Parse(s)
+		if err != nil {
+			panic(err)
+		}
+		fs = append(fs, f)
+	}
+
+	var ps []booru.Post
+	for i := 0; i < 100; i++ {
+		p := booru.Post{
+			Rating:     booru.Rating(r.Intn(4)),
+			Score:      r.Intn(10),
+			Created:    time.Now().Add(-time.Duration(r.Intn(60*24)) * time.Hour),
+			Original:   booru.Image{Width: r.Intn(4000)},
+			Categories: map[string]booru.TagCategory{},
+		}
+
+		for j := 0; j < 30; j++ {
+			t := tag()
+			p.Tags = append(p.Tags, t)
+			if j%5 == 0 {
+				p.Categories[t] = booru.TagCategory(r.Intn(5))
+			}
+		}
+		ps = append(ps, p)
+	}
+
+	return fs, ps
+}
+
+// matchLinear finds the first matching filter by trying each of them.
+func matchLinear(fs []Filter, p *booru.Post) (Filter, bool) {
+	for _, f := range fs {
+		if f.Match(p) {
+			return f, true
+		}
+	}
+	return Filter{}, false
+}
+
+func TestSetMatchesLinear(t *testing.T) {
+	for _, n := range []int{1, 10, 300, 3000} {
+		fs, ps := randomFilters(n, 300, 10)
+		s := Compile(fs)
+
+		hits := 0
+		for i := range ps {
+			wf, want := matchLinear(fs, &ps[i])
+			gf, got := s.Match(&ps[i])
+			if want != got || wf.String() != gf.String() {
+				t.Fatalf("%d filters, post %d: Set.Match = %q, %v; Filter.Match = %q, %v", n, i, gf, got, wf, want)
+			}
+
+			if got {
+				hits++
+			}
+		}
+
+		if n >= 300 && hits == 0 {
+			t.Errorf("%d filters matched no posts, which doesn't test much", n)
+		}
+	}
+}
+
+// benchmarkKinds are the kinds of filters benchmarked: a typical blacklist
+// which can be indexed entirely, and one using every kind of term.
+var benchmarkKinds = []struct {
+	name  string
+	kinds int
+}{
+	{"indexed", 5},
+	{"mixed", 10},
+}
+
+// The benchmarks match 3000 filters against a page of 100 posts with 30 tags
+// each.
+
+func BenchmarkLinear(b *testing.B) {
+	for _, k := range benchmarkKinds {
+		b.Run(k.name, func(b *testing.B) {
+			fs, ps := randomFilters(3000, 5000, k.kinds)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for j := range ps {
+					matchLinear(fs, &ps[j])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	for _, k := range benchmarkKinds {
+		b.Run(k.name, func(b *testing.B) {
+			fs, ps := randomFilters(3000, 5000, k.kinds)
+			s := Compile(fs)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for j := range ps {
+					s.Match(&ps[j])
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package boorumux
 
 import (
+	"context"
 	"fmt"
 	"html/template"
+	"log"
 	"mime"
 	"net/http"
 	"sort"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/KushBlazingJudah/boorumux/booru"
+	"github.com/KushBlazingJudah/boorumux/filter"
 )
 
 var templates *template.Template
@@ -25,6 +28,43 @@ var ssPool = sync.Pool{
 	},
 }
 
+// pagePost is a post as it is shown on a page.
+type pagePost struct {
+	booru.Post
+
+	// Hidden is the blacklist filter that matched this post, if any.
+	Hidden string
+
+	// Highlight is the highlight filter that matched this post, if any.
+	Highlight string
+
+	// Placeholder is a tiny version of the thumbnail shown while it loads.
+	Placeholder template.URL
+}
+
+// tagGroup is a list of tags in the same category, as shown on a post.
+type tagGroup struct {
+	Category booru.TagCategory
+	Tags     []string
+}
+
+// sidebarTag is a tag as it is shown in the sidebar of a page.
+type sidebarTag struct {
+	Name string
+
+	// Count is how many posts on the page have the tag.
+	Count int
+
+	// Total is how many posts on the booru have the tag, or -1 if unknown.
+	Total int
+}
+
+// hiddenRule counts how many posts a blacklist filter hid.
+type hiddenRule struct {
+	Rule  string
+	Count int
+}
+
 var mimeExt = map[string]string{
 	"image/jpeg": ".jpg",
 	"image/png":  ".png",
@@ -40,6 +80,7 @@ func init() {
 		"humantag":   func(s string) string { return strings.ReplaceAll(s, "_", " ") },
 		"size":       humanSize,
 		"pages":      buildPageBlock,
+		"cursors":    buildCursorBlock,
 		"isUrl":      schemaRegexp.MatchString,
 		"prettyUrl":  prettyUrl,
 		"concat":     func(s []string, c string) string { return strings.Join(s, c) },
@@ -47,21 +88,28 @@ func init() {
 		"ver":        func() string { return verString },
 		"mkUrl":      mkUrl,
 		"has_string": has[string],
-		"ext": func(m string) string {
-			e, ok := mimeExt[m]
-			if ok {
-				return e
-			}
-
-			ex, _ := mime.ExtensionsByType(m)
-			if ex == nil {
-				return ""
-			}
-			return ex[0]
-		},
+		"can":        can,
+		"orders":     func() map[string]string { return searchOrders },
+		"ratings":    func() []string { return []string{"general", "sensitive", "questionable", "explicit"} },
+		"ext":        mimeExtension,
+		"proxy":      func() error { panic("proxy called too early") },
 	}).ParseGlob("./views/*.html"))
 }
 
+// mimeExtension returns the file extension of a MIME type, including the dot.
+func mimeExtension(m string) string {
+	e, ok := mimeExt[m]
+	if ok {
+		return e
+	}
+
+	ex, _ := mime.ExtensionsByType(m)
+	if ex == nil {
+		return ""
+	}
+	return ex[0]
+}
+
 func checkin(d map[string]interface{}) {
 	for k := range d {
 		delete(d, k)
@@ -97,37 +145,246 @@ func (s *Server) findBooru(r *http.Request, target string) (booru.API, error) {
 	return b, nil
 }
 
-func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request, targetBooru string, page int, tags []string) {
+// blacklistFor returns the compiled blacklist for posts from origin, shown
+// through the booru named via.
+// Both are usually the same, unless the post is being shown through a mux.
+//
+// The blacklist of via only ever adds to the blacklist of origin; whether the
+// global blacklist applies is up to origin alone, as via may come from a link.
+func (s *Server) blacklistFor(via, origin string) *filter.Set {
+	key := via + "\x00" + origin
+
+	s.Lock()
+	defer s.Unlock()
+
+	if set, ok := s.blacklists[key]; ok {
+		return set
+	}
+
+	var fs []filter.Filter
+	if ob := s.Blacklists[origin]; !ob.Override {
+		fs = append(fs, s.Blacklist...)
+	}
+
+	fs = append(fs, s.Blacklists[origin].Filters...)
+	if via != origin {
+		fs = append(fs, s.Blacklists[via].Filters...)
+	}
+
+	if s.blacklists == nil {
+		s.blacklists = map[string]*filter.Set{}
+	}
+
+	set := s.compile(fs)
+	s.blacklists[key] = set
+	return set
+}
+
+// categoryTimeout is how long a booru has to look up the categories of tags
+// that the blacklist depends on.
+const categoryTimeout = 5 * time.Second
+
+// categorize looks up the categories of the tags on posts that are needed by
+// the blacklist shown through via, for boorus that don't send them along.
+// Otherwise, these boorus only give the categories they already know, which
+// would let blacklisted posts through.
+func (s *Server) categorize(ctx context.Context, via string, posts []booru.Post) {
+	byOrigin := map[booru.Categorizer][]int{}
+	for i, p := range posts {
+		c, ok := p.Origin.(booru.Categorizer)
+		if !ok || !s.blacklistFor(via, s.booruName(p.Origin)).UsesCategories() {
+			continue
+		}
+		byOrigin[c] = append(byOrigin[c], i)
+	}
+
+	if len(byOrigin) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, categoryTimeout)
+	defer cancel()
+
+	for c, idx := range byOrigin {
+		ps := make([]booru.Post, len(idx))
+		for j, i := range idx {
+			ps[j] = posts[i]
+		}
+
+		if err := c.Categorize(ctx, ps); err != nil {
+			log.Printf("failed looking up tag categories on %s: %v", s.booruName(posts[idx[0]].Origin), err)
+		}
+
+		for j, i := range idx {
+			posts[i].Categories = ps[j].Categories
+		}
+	}
+}
+
+// compile compiles a list of filters, renaming their tags using the tag map
+// so they match posts the same way no matter which name they were written
+// with.
+func (s *Server) compile(fs []filter.Filter) *filter.Set {
+	if s.Tags != nil && len(s.Tags.Aliases) > 0 {
+		fs = append([]filter.Filter(nil), fs...)
+		for i, f := range fs {
+			fs[i] = f.Alias(s.Tags.Alias)
+		}
+	}
+
+	return filter.Compile(fs)
+}
+
+// highlightSet returns the compiled highlight list, compiling it if needed.
+func (s *Server) highlightSet() *filter.Set {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.highlight == nil {
+		s.highlight = s.compile(s.Highlight)
+	}
+
+	return s.highlight
+}
+
+// booruName finds the name a booru was configured with.
+func (s *Server) booruName(b booru.API) string {
+	for k, v := range s.Boorus {
+		if v == b {
+			return k
+		}
+	}
+	return ""
+}
+
+// unsupportedTerms finds the search terms that tb, or any of its members if it
+// is a Mux, can't understand.
+// The returned map is keyed by the name of the booru.
+func (s *Server) unsupportedTerms(tb booru.API, q booru.Query) map[string][]string {
+	members := []booru.API{tb}
+	if m, ok := tb.(Mux); ok {
+		members = m
+	}
+
+	out := map[string][]string{}
+	for _, b := range members {
+		_, bad := booru.Translate(b, q)
+		for _, t := range bad {
+			n := s.booruName(b)
+			out[n] = append(out[n], t.String())
+		}
+	}
+
+	return out
+}
+
+func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request, targetBooru string, page int, sr search, q booru.Query) {
 	tb, err := s.findBooru(r, targetBooru)
 	if err != nil {
 		panic(err)
 	}
 
-	data, _, err := tb.Page(r.Context(), booru.Query{Tags: tags}, page)
+	data, remaining, err := tb.Page(r.Context(), q, page)
 	if err != nil {
 		panic(err)
 	}
 
+	s.categorize(r.Context(), targetBooru, data)
+	for i := range data {
+		s.Tags.NormalizePost(&data[i])
+	}
+
+	// Find out how many posts there are, if we can
+	total := -1
+	if c, ok := tb.(booru.Counter); ok && booru.CapabilitiesOf(tb).Has(booru.CapTotal) {
+		if n, err := c.Count(r.Context(), q); err == nil {
+			total = n
+		} else {
+			log.Printf("failed counting posts on %s: %v", targetBooru, err)
+		}
+	}
+
+	last := -1
+	if remaining >= 0 {
+		last = page + remaining - 1
+		if last < 0 {
+			last = 0
+		}
+	}
+
 	reqTime := time.Now()
 
-	// Filter out blacklisted tags
-	// This looks weird but trust me on this; it's simply an in-place filter.
-	n := 0
+	// Pages are numbered as far as the booru lets them go, as long as we
+	// know how many there are; cursors are only used past that
+	cursorMode := useCursor(tb, q) && (q.BeforeID != 0 || q.AfterID != 0 || total < 0)
+
+	// Find the cursors for the next and previous pages before anything is
+	// filtered out
+	var cursor struct {
+		First      bool
+		Prev, Next int
+	}
+	if useCursor(tb, q) {
+		cursor.First = q.BeforeID != 0 || q.AfterID != 0
+		for _, v := range data {
+			if cursor.Next == 0 || v.Id < cursor.Next {
+				cursor.Next = v.Id
+			}
+			if v.Id > cursor.Prev {
+				cursor.Prev = v.Id
+			}
+		}
+
+		if q.BeforeID == 0 && q.AfterID == 0 {
+			// First page, nothing before it
+			cursor.Prev = 0
+		} else if len(data) == 0 && q.BeforeID != 0 {
+			// Ran off the end; go back to where we were
+			cursor.Prev = q.BeforeID - 1
+		}
+	}
+
+	// On the last page that can be numbered, carry on from it with a cursor
+	more := 0
+	if !cursorMode && useCursor(tb, q) && page == booru.MaxPageOf(tb, q.Limit) && last == page {
+		more = cursor.Next
+	}
+
+	// Find blacklisted posts, and only keep them if they were asked for
+	showHidden := r.URL.Query().Get("hidden") != ""
+	posts := make([]pagePost, 0, len(data))
+	var hidden []hiddenRule
+	nHidden := 0
+
+	hl := s.highlightSet()
 	for _, v := range data {
-		fine := true
-		for _, f := range s.Blacklist {
-			if f.Match(&v) {
-				fine = false
-				break
+		f, hide := s.blacklistFor(targetBooru, s.booruName(v.Origin)).Match(&v)
+		if !hide {
+			pp := pagePost{Post: v, Placeholder: s.placeholder(&v)}
+			if f, ok := hl.Match(&v); ok {
+				pp.Highlight = f.String()
 			}
+
+			posts = append(posts, pp)
+			continue
 		}
 
-		if fine {
-			data[n] = v
-			n++
+		nHidden++
+		hidden = countRule(hidden, f.String())
+		if showHidden {
+			posts = append(posts, pagePost{Post: v, Hidden: f.String()})
 		}
 	}
-	data = data[:n]
+
+	sort.SliceStable(hidden, func(i, j int) bool {
+		return hidden[i].Count > hidden[j].Count
+	})
+
+	if s.HighlightFirst {
+		sort.SliceStable(posts, func(i, j int) bool {
+			return posts[i].Highlight != "" && posts[j].Highlight == ""
+		})
+	}
 
 	// Find all of the tags on this page
 	ssptr := ssPool.Get().(*[]string)
@@ -136,12 +393,16 @@ func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request, targetBooru
 	ss := *ssptr
 	ss = ss[:0]
 
-	for _, p := range data {
+	for _, p := range posts {
+		if p.Hidden != "" {
+			continue
+		}
+
 		for _, v := range p.Tags {
 			ok := true
 
-			for _, k := range tags {
-				if v == k {
+			for _, k := range q.Tags {
+				if v == s.Tags.Alias(k) {
 					ok = false
 					break
 				}
@@ -153,11 +414,20 @@ func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request, targetBooru
 		}
 	}
 
-	pageTags := mostCommon(ss)
-	if len(pageTags) > maxSidebarTags {
-		pageTags = pageTags[:maxSidebarTags]
+	// Remember the categories of them too, so they can be told apart
+	tagCats := map[string]string{}
+	for _, p := range posts {
+		if p.Hidden != "" {
+			continue
+		}
+
+		for t, c := range p.Categories {
+			tagCats[t] = c.String()
+		}
 	}
 
+	pageTags := s.sidebarTags(r.Context(), targetBooru, tb, mostCommon(ss), sr)
+
 	// Render it out
 	tmpldata := mapPool.Get().(map[string]interface{})
 	defer checkin(tmpldata)
@@ -168,11 +438,30 @@ func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request, targetBooru
 
 	tmpldata["booru"] = targetBooru
 	tmpldata["boorus"] = s.boorus
-	tmpldata["activeTags"] = tags
+	tmpldata["caps"] = booru.CapabilitiesOf(tb)
+	tmpldata["activeTags"] = q.Tags
 	tmpldata["tags"] = pageTags
-	tmpldata["posts"] = data
+	tmpldata["tagCats"] = tagCats
+	tmpldata["tagSorts"] = tagSorts
+	tmpldata["unsupported"] = s.unsupportedTerms(tb, q)
+	tmpldata["posts"] = posts
+	tmpldata["hidden"] = hidden
+	tmpldata["nHidden"] = nHidden
+	tmpldata["showHidden"] = showHidden
+	tmpldata["toggleHidden"] = toggleParam(r.URL, "hidden")
 	tmpldata["page"] = page
-	tmpldata["q"] = r.URL.Query().Get("q")
+	tmpldata["last"] = last
+	tmpldata["total"] = total
+	tmpldata["more"] = more
+	if cursorMode {
+		tmpldata["cursor"] = cursor
+	}
+	tmpldata["q"] = sr.Q
+	tmpldata["search"] = sr
+	tmpldata["dataSaver"] = dataSaver(r)
+	if dataSaver(r) {
+		tmpldata["thumbWidth"] = thumbWidth
+	}
 
 	if tmpldata["q"] == "" {
 		tmpldata["title"] = fmt.Sprintf("%s #%d - Boorumux", targetBooru, page)
@@ -185,20 +474,14 @@ func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request, targetBooru
 		"embed": func() error {
 			return t.Lookup("page.html").Execute(w, tmpldata)
 		},
-		"booruId": func(b booru.API) string {
-			for k, v := range s.Boorus {
-				if v == b {
-					return k
-				}
-			}
-			return ""
-		},
+		"booruId": s.booruName,
+		"proxy":   s.proxyURL,
 	}).ExecuteTemplate(w, "main.html", tmpldata)
 
 	fmt.Fprintf(w, "<!-- rendered in %s -->", time.Since(reqTime).Truncate(time.Microsecond).String())
 }
 
-func (s *Server) postHandler(w http.ResponseWriter, r *http.Request, targetBooru string, id int) {
+func (s *Server) postHandler(w http.ResponseWriter, r *http.Request, targetBooru string, id int, sr search) {
 	data, err := s.Boorus[targetBooru].Post(r.Context(), id)
 	if err != nil {
 		panic(err)
@@ -206,7 +489,20 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request, targetBooru
 
 	reqTime := time.Now()
 
+	// Check the blacklist of the mux the post was found through too, if it
+	// was; anything else can't change which blacklist applies
+	via := r.URL.Query().Get("from")
+	if _, ok := s.Boorus[via].(Mux); !ok {
+		via = targetBooru
+	}
+
 	// Sort it out
+	if s.PostBlacklist != BlacklistOff {
+		ps := []booru.Post{*data}
+		s.categorize(r.Context(), via, ps)
+		data.Categories = ps[0].Categories
+	}
+	s.Tags.NormalizePost(data)
 	sort.Strings(data.Tags)
 
 	// Render it out
@@ -217,18 +513,137 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request, targetBooru
 		tmpldata["mux"] = r.URL.Query()["b"]
 	}
 
+	if s.PostBlacklist != BlacklistOff {
+		f, hide := s.blacklistFor(via, targetBooru).Match(data)
+		if hide && (s.PostBlacklist == BlacklistBlock || r.URL.Query().Get("show") == "") {
+			s.blockedHandler(w, r, tmpldata, targetBooru, sr, f)
+			return
+		}
+	}
+
 	tmpldata["title"] = fmt.Sprintf("%s on %s - Boorumux", strings.Join(data.Tags, " "), targetBooru)
 	tmpldata["booru"] = targetBooru
 	tmpldata["boorus"] = s.boorus
-	tmpldata["tags"] = data.Tags
+	tmpldata["caps"] = booru.CapabilitiesOf(s.Boorus[targetBooru])
+	tmpldata["tagGroups"] = groupTags(data)
 	tmpldata["post"] = data
-	tmpldata["q"] = r.URL.Query().Get("q")
+	tmpldata["q"] = sr.Q
+	tmpldata["search"] = sr
+	tmpldata["from"] = r.URL.Query().Get("from")
+
+	// Show the sample unless the original was asked for, as originals can be
+	// huge
+	hasSample := data.Sample.Href != "" && data.Sample.Href != data.Original.Href && !data.Sample.IsVideo()
+	tmpldata["hasSample"] = hasSample
+	tmpldata["toggleOriginal"] = toggleParam(r.URL, "original")
+	if hasSample && r.URL.Query().Get("original") == "" {
+		tmpldata["variant"] = "sample"
+	} else {
+		tmpldata["variant"] = "orig"
+	}
+
+	t := template.Must(templates.Clone())
+	t.Funcs(template.FuncMap{
+		"embed": func() error {
+			return t.Lookup("post.html").Execute(w, tmpldata)
+		},
+		"proxy": s.proxyURL,
+	}).ExecuteTemplate(w, "main.html", tmpldata)
+
+	fmt.Fprintf(w, "<!-- rendered in %s -->", time.Since(reqTime).Truncate(time.Microsecond).String())
+}
+
+// blockedHandler renders a notice in place of a blacklisted post.
+func (s *Server) blockedHandler(w http.ResponseWriter, r *http.Request, tmpldata map[string]interface{}, targetBooru string, sr search, f filter.Filter) {
+	tmpldata["title"] = "Blacklisted post - Boorumux"
+	tmpldata["booru"] = targetBooru
+	tmpldata["q"] = sr.Q
+	tmpldata["search"] = sr
 	tmpldata["from"] = r.URL.Query().Get("from")
 
+	tmpldata["rule"] = f.String()
+
+	if s.PostBlacklist == BlacklistBlock {
+		w.WriteHeader(http.StatusForbidden)
+	} else {
+		tmpldata["show"] = toggleParam(r.URL, "show")
+	}
+
 	t := template.Must(templates.Clone())
 	t.Funcs(template.FuncMap{"embed": func() error {
-		return t.Lookup("post.html").Execute(w, tmpldata)
+		return t.Lookup("blocked.html").Execute(w, tmpldata)
 	}}).ExecuteTemplate(w, "main.html", tmpldata)
+}
 
-	fmt.Fprintf(w, "<!-- rendered in %s -->", time.Since(reqTime).Truncate(time.Microsecond).String())
+// groupTags sorts the tags of a post by category, in the order categories are
+// usually shown in.
+func groupTags(p *booru.Post) []tagGroup {
+	m := map[booru.TagCategory][]string{}
+	for _, t := range p.Tags {
+		c := p.Category(t)
+		m[c] = append(m[c], t)
+	}
+
+	out := make([]tagGroup, 0, len(m))
+	for _, c := range booru.Categories {
+		if len(m[c]) > 0 {
+			out = append(out, tagGroup{Category: c, Tags: m[c]})
+		}
+	}
+
+	return out
+}
+
+// sidebarTags picks the tags shown in the sidebar of a page out of the ones
+// counted on it.
+// If the booru can, how many posts have each of them in total is looked up
+// too; if that fails, they are shown without it.
+func (s *Server) sidebarTags(ctx context.Context, name string, b booru.API, counted []tally, sr search) []sidebarTag {
+	n := sr.tagLimit()
+	byTotal := sr.TagSort == "total"
+
+	tags := make([]sidebarTag, len(counted))
+	for i, v := range counted {
+		tags[i] = sidebarTag{Name: v.Item, Count: v.Count, Total: -1}
+	}
+
+	// Every tag needs its total to sort by it, otherwise only the ones shown
+	// do
+	if !byTotal && len(tags) > n {
+		tags = tags[:n]
+	}
+
+	if tl, ok := b.(booru.TagLooker); ok && booru.CapabilitiesOf(b).Has(booru.CapTagCounts) && len(tags) > 0 {
+		names := make([]string, len(tags))
+		for i, v := range tags {
+			names[i] = v.Name
+		}
+
+		if found, err := tl.LookupTags(ctx, names); err == nil {
+			totals := make(map[string]int, len(found))
+			for _, v := range found {
+				totals[v.Name] = v.Count
+			}
+
+			for i, v := range tags {
+				if t, ok := totals[v.Name]; ok {
+					tags[i].Total = t
+				}
+			}
+		} else {
+			log.Printf("failed looking up tags on %s: %v", name, err)
+		}
+	}
+
+	if byTotal {
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].Total > tags[j].Total
+		})
+	}
+
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+
+	return tags
 }
@@ -25,6 +25,7 @@ func (m Mux) Page(ctx context.Context, q booru.Query, page int) ([]booru.Post, i
 	var cerr error
 
 	dc := make(chan []booru.Post, len(m))
+	rc := make(chan int, len(m))
 
 	for _, v := range m {
 		wg.Add(1)
@@ -32,7 +33,7 @@ func (m Mux) Page(ctx context.Context, q booru.Query, page int) ([]booru.Post, i
 		go func(b booru.API) {
 			defer wg.Done()
 
-			r, _, err := b.Page(ctx, q, page)
+			r, rem, err := b.Page(ctx, q, page)
 			if err != nil && !errors.Is(err, context.Canceled) {
 				cerr = err
 				cancel()
@@ -41,6 +42,7 @@ func (m Mux) Page(ctx context.Context, q booru.Query, page int) ([]booru.Post, i
 
 			if err == nil {
 				dc <- r
+				rc <- rem
 				atomic.AddInt32(&n, int32(len(r)))
 			}
 		}(v)
@@ -48,11 +50,23 @@ func (m Mux) Page(ctx context.Context, q booru.Query, page int) ([]booru.Post, i
 
 	wg.Wait()
 	close(dc)
+	close(rc)
 
 	if cerr != nil {
 		return nil, -1, cerr
 	}
 
+	// There are as many pages left as the booru with the most pages left,
+	// unless any of them don't know
+	remaining := 0
+	for v := range rc {
+		if v < 0 || remaining < 0 {
+			remaining = -1
+		} else if v > remaining {
+			remaining = v
+		}
+	}
+
 	results := make([]booru.Post, 0, n)
 	for v := range dc {
 		results = append(results, v...)
@@ -62,7 +76,157 @@ func (m Mux) Page(ctx context.Context, q booru.Query, page int) ([]booru.Post, i
 		return results[i].Created.After(results[j].Created)
 	})
 
-	return results, -1, nil
+	return results, remaining, nil
+}
+
+// Count returns the sum of the number of posts matching a query on every
+// booru.
+func (m Mux) Count(ctx context.Context, q booru.Query) (int, error) {
+	total := 0
+	for _, b := range m {
+		c, ok := b.(booru.Counter)
+		if !ok {
+			return 0, errors.New("mux: booru can't count posts")
+		}
+
+		n, err := c.Count(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// Tags searches for tags on every booru that can, adding up the counts of
+// tags found on more than one of them.
+// Boorus that fail are skipped, unless they all do.
+func (m Mux) Tags(ctx context.Context, prefix string) ([]booru.Tag, error) {
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+
+	var found []booru.Tag
+	var cerr error
+	ok := false
+
+	for _, v := range m {
+		t, isTagger := v.(booru.Tagger)
+		if !isTagger || !booru.CapabilitiesOf(v).Has(booru.CapAutocomplete) {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(t booru.Tagger) {
+			defer wg.Done()
+
+			r, err := t.Tags(ctx, prefix)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				cerr = err
+				return
+			}
+
+			ok = true
+			found = append(found, r...)
+		}(t)
+	}
+
+	wg.Wait()
+
+	if !ok {
+		if cerr == nil {
+			cerr = errors.New("mux: no booru can search for tags")
+		}
+		return nil, cerr
+	}
+
+	results := mergeTags(found)
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Name < results[j].Name
+	})
+
+	if len(results) > booru.TagLimit {
+		results = results[:booru.TagLimit]
+	}
+
+	return results, nil
+}
+
+// LookupTags looks up tags on every booru, adding up how many posts have them.
+func (m Mux) LookupTags(ctx context.Context, names []string) ([]booru.Tag, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+
+	var found []booru.Tag
+	var cerr error
+
+	for _, v := range m {
+		if _, ok := v.(booru.TagLooker); !ok {
+			return nil, errors.New("mux: booru can't look up tags")
+		}
+	}
+
+	for _, v := range m {
+		wg.Add(1)
+
+		go func(t booru.TagLooker) {
+			defer wg.Done()
+
+			r, err := t.LookupTags(ctx, names)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if cerr == nil {
+					cerr = err
+				}
+				cancel()
+				return
+			}
+
+			found = append(found, r...)
+		}(v.(booru.TagLooker))
+	}
+
+	wg.Wait()
+
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return mergeTags(found), nil
+}
+
+// Capabilities returns the features supported by every booru in the mux.
+// Autocompletion is the exception, which only needs to be supported by one of
+// them, and cursors are never supported as IDs differ between boorus.
+func (m Mux) Capabilities() booru.Capability {
+	all := ^booru.Capability(0)
+	var some booru.Capability
+
+	for _, b := range m {
+		c := booru.CapabilitiesOf(b)
+		all &= c
+		some |= c
+	}
+
+	if len(m) == 0 {
+		all = 0
+	}
+
+	return (all &^ booru.CapCursor) | (some & booru.CapAutocomplete)
 }
 
 func (m Mux) Post(ctx context.Context, id int) (*booru.Post, error) {
@@ -72,3 +236,25 @@ func (m Mux) Post(ctx context.Context, id int) (*booru.Post, error) {
 func (m Mux) HTTP() *http.Client {
 	return nil
 }
+
+// mergeTags merges tags with the same name found on several boorus, adding up
+// their counts.
+func mergeTags(tags []booru.Tag) []booru.Tag {
+	idx := map[string]int{}
+	out := make([]booru.Tag, 0, len(tags))
+	for _, v := range tags {
+		i, ok := idx[v.Name]
+		if !ok {
+			idx[v.Name] = len(out)
+			out = append(out, v)
+			continue
+		}
+
+		out[i].Count += v.Count
+		if out[i].Category == booru.CategoryGeneral {
+			out[i].Category = v.Category
+		}
+	}
+
+	return out
+}
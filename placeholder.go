@@ -0,0 +1,152 @@
+package boorumux
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+const (
+	// placeholderWidth is the width of thumbnail placeholders in pixels.
+	placeholderWidth = 8
+
+	// placeholderQueue is how many placeholders may be waiting to be made
+	// before more are ignored.
+	placeholderQueue = 256
+
+	// placeholderWorkers is how many placeholders are made at once.
+	placeholderWorkers = 2
+)
+
+// placeholderJob is a placeholder waiting to be made.
+type placeholderJob struct {
+	key  string
+	name string
+	b    booru.API
+	href string
+}
+
+// placeholder returns a tiny, blurry version of the thumbnail of a post as a
+// data URI, so something can be shown while the real one loads.
+//
+// Placeholders are made in the background and kept in the media cache; if it
+// hasn't been made yet, one is queued and an empty string is returned.
+func (s *Server) placeholder(p *booru.Post) template.URL {
+	name := s.booruName(p.Origin)
+	b, ok := s.Boorus[name]
+	if !ok || p.Preview.Href == "" {
+		return ""
+	}
+
+	key := fmt.Sprintf("placeholder/%s/%d", name, p.Id)
+	if e, ok := s.cache().get(key); ok {
+		return template.URL("data:" + e.mime + ";base64," + base64.StdEncoding.EncodeToString(e.data))
+	}
+
+	s.queuePlaceholder(placeholderJob{key: key, name: name, b: b, href: p.Preview.Href})
+	return ""
+}
+
+// queuePlaceholder queues a placeholder to be made, unless it already is.
+// Jobs are dropped if the queue is full; they'll be queued again the next time
+// the post is shown.
+func (s *Server) queuePlaceholder(j placeholderJob) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.placeholders == nil {
+		s.placeholders = make(chan placeholderJob, placeholderQueue)
+		s.pending = map[string]struct{}{}
+
+		for i := 0; i < placeholderWorkers; i++ {
+			go s.placeholderWorker()
+		}
+	}
+
+	if _, ok := s.pending[j.key]; ok {
+		return
+	}
+
+	select {
+	case s.placeholders <- j:
+		s.pending[j.key] = struct{}{}
+	default:
+	}
+}
+
+func (s *Server) placeholderWorker() {
+	for j := range s.placeholders {
+		data, err := s.makePlaceholder(j)
+		if err != nil {
+			log.Printf("failed making placeholder for %s: %v", j.href, err)
+		} else {
+			s.cache().put(j.key, "image/png", data)
+		}
+
+		s.Lock()
+		delete(s.pending, j.key)
+		s.Unlock()
+	}
+}
+
+// makePlaceholder downloads a thumbnail, and shrinks it down to a placeholder.
+// It goes through the same checks as the proxy.
+func (s *Server) makePlaceholder(j placeholderJob) ([]byte, error) {
+	u, err := url.Parse(j.href)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkProxyURL(booru.HostsOf(j.b), u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyIdleTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.proxyClient(j.name, j.b).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResizeInput+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxResizeInput {
+		return nil, fmt.Errorf("thumbnail is too large")
+	}
+
+	resizeSem <- struct{}{}
+	defer func() { <-resizeSem }()
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, downscale(img, placeholderWidth)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,467 @@
+package boorumux
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// proxyReqHeaders is a list of headers that are sent with a proxy request to a
+// booru.
+var proxyReqHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// proxyRespHeaders is a list of headers copied from the response from the
+// server for a proxy request.
+var proxyRespHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Accept-Ranges",
+	"Last-Modified",
+	"Etag",
+	"Expires",
+	"Cache-Control",
+}
+
+// proxyVariants maps the variants of a post's media that can be proxied to a
+// function returning it.
+var proxyVariants = map[string]func(p *booru.Post) booru.Image{
+	"preview": func(p *booru.Post) booru.Image { return p.Preview },
+	"sample":  func(p *booru.Post) booru.Image { return p.Sample },
+	"orig":    func(p *booru.Post) booru.Image { return p.Original },
+}
+
+const (
+	// maxProxyTargets is how many upstream URLs are remembered for proxy
+	// links that were recently rendered.
+	maxProxyTargets = 8192
+
+	// proxyIdleTimeout is how long the proxy waits on a booru to send
+	// something before giving up.
+	proxyIdleTimeout = 30 * time.Second
+
+	// proxySigLen is the length of the signature in a proxy token, in bytes.
+	proxySigLen = 12
+)
+
+// errBadToken is returned for proxy tokens that are malformed or weren't
+// signed by us.
+var errBadToken = errors.New("invalid proxy token")
+
+// proxyFile is what a proxy token refers to.
+type proxyFile struct {
+	// Href is the upstream URL.
+	Href string
+
+	// Name is the file name given to the browser.
+	Name string
+
+	// MIME is the type of the file, as far as the booru knows.
+	MIME string
+}
+
+// targetCache remembers the upstream URL of recently rendered proxy links, so
+// the post doesn't have to be looked up again when the browser asks for it.
+type targetCache struct {
+	m map[string]proxyFile
+	sync.Mutex
+}
+
+func (c *targetCache) get(k string) (proxyFile, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	v, ok := c.m[k]
+	return v, ok
+}
+
+func (c *targetCache) put(k string, v proxyFile) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.m == nil {
+		c.m = map[string]proxyFile{}
+	}
+
+	if len(c.m) >= maxProxyTargets {
+		// Throw out something; a miss only costs a lookup
+		for k := range c.m {
+			delete(c.m, k)
+			break
+		}
+	}
+
+	c.m[k] = v
+}
+
+// secret returns the key proxy tokens are signed with, generating one if it
+// wasn't configured.
+func (s *Server) secret() []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.Secret) == 0 {
+		s.Secret = make([]byte, 32)
+		if _, err := rand.Read(s.Secret); err != nil {
+			panic(err)
+		}
+	}
+
+	return s.Secret
+}
+
+// sign signs a proxy token for a variant of a post on the booru named name.
+func (s *Server) sign(name string, id int, variant string) string {
+	m := hmac.New(sha256.New, s.secret())
+	fmt.Fprintf(m, "%s\x00%d\x00%s", name, id, variant)
+	return hex.EncodeToString(m.Sum(nil)[:proxySigLen])
+}
+
+// fileOf describes a variant of the media of a post.
+// Files are named after their hash so saving them gives a sensible name.
+func fileOf(p *booru.Post, variant string, i booru.Image) proxyFile {
+	name := p.Hash
+	if name == "" {
+		name = strconv.Itoa(p.Id)
+	}
+
+	if variant != "orig" {
+		name += "_" + variant
+	}
+
+	return proxyFile{Href: i.Href, Name: name + mimeExtension(i.MIME), MIME: i.MIME}
+}
+
+// proxyURL returns the link to the proxied media of a post.
+//
+// Links are of the form /{booru}/proxy/{id}-{variant}-{signature}{ext}, so
+// clients can't use the proxy to fetch anything but the media of posts.
+func (s *Server) proxyURL(p booru.Post, variant string) string {
+	img, ok := proxyVariants[variant]
+	if !ok {
+		panic("unknown proxy variant " + variant)
+	}
+	i := img(&p)
+
+	name := s.booruName(p.Origin)
+	token := fmt.Sprintf("%d-%s-%s", p.Id, variant, s.sign(name, p.Id, variant))
+	if i.Href != "" {
+		s.targets.put(name+"/"+token, fileOf(&p, variant, i))
+	}
+
+	return "/" + name + "/proxy/" + token + mimeExtension(i.MIME)
+}
+
+// proxyTarget checks a proxy token, and finds the file it refers to.
+func (s *Server) proxyTarget(ctx context.Context, name string, b booru.API, token string) (proxyFile, error) {
+	parts := strings.Split(token, "-")
+	if len(parts) != 3 {
+		return proxyFile{}, errBadToken
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return proxyFile{}, errBadToken
+	}
+
+	img, ok := proxyVariants[parts[1]]
+	if !ok {
+		return proxyFile{}, errBadToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(name, id, parts[1]))) {
+		return proxyFile{}, errBadToken
+	}
+
+	if v, ok := s.targets.get(name + "/" + token); ok {
+		return v, nil
+	}
+
+	p, err := b.Post(ctx, id)
+	if err != nil {
+		return proxyFile{}, err
+	}
+
+	f := fileOf(p, parts[1], img(p))
+	if f.Href == "" {
+		return proxyFile{}, booru.ErrNotFound
+	}
+	s.targets.put(name+"/"+token, f)
+	return f, nil
+}
+
+// cgnat is the shared address space used by carrier-grade NAT, which isn't
+// considered private by the net package.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip is reachable on the internet, as opposed to
+// something on our own network.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnat.Contains(ip))
+}
+
+// checkProxyURL makes sure the proxy is allowed to fetch u, as it would
+// otherwise be usable by anyone to reach whatever they want.
+func checkProxyURL(hosts []string, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme \"%s\" is not allowed", u.Scheme)
+	}
+
+	if !booru.MatchHost(hosts, u.Hostname()) {
+		return fmt.Errorf("host \"%s\" is not allowed", u.Hostname())
+	}
+
+	return nil
+}
+
+// proxyClient returns the client used to proxy files from a booru.
+//
+// It uses the same transport settings as the booru itself, but only follows
+// redirects to the booru's hosts and refuses to connect to private addresses.
+// Hosts named exactly, such as the booru itself, and the HTTP proxy it uses
+// are exempt, since they were configured by whoever runs this server.
+func (s *Server) proxyClient(name string, b booru.API) *http.Client {
+	s.Lock()
+	defer s.Unlock()
+
+	if c, ok := s.proxies[name]; ok {
+		return c
+	}
+
+	hosts := booru.HostsOf(b)
+
+	var t *http.Transport
+	if bt, ok := b.HTTP().Transport.(*http.Transport); ok {
+		t = bt.Clone()
+	} else {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	trusted := map[string]struct{}{}
+	for _, h := range hosts {
+		if !strings.HasPrefix(h, "*.") {
+			trusted[h] = struct{}{}
+		}
+	}
+
+	if t.Proxy != nil && len(hosts) > 0 {
+		pu, err := t.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: hosts[0]}})
+		if err == nil && pu != nil {
+			trusted[strings.ToLower(pu.Hostname())] = struct{}{}
+		}
+	}
+
+	plain := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+
+		// This is called after DNS resolution, so it also catches names
+		// pointing at private addresses
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("refusing to connect to %s", address)
+			}
+			return nil
+		},
+	}
+
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := trusted[strings.ToLower(host)]; ok {
+			return plain.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+
+	t.TLSHandshakeTimeout = 10 * time.Second
+	t.ResponseHeaderTimeout = proxyIdleTimeout
+	t.IdleConnTimeout = 90 * time.Second
+
+	c := &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkProxyURL(hosts, req.URL)
+		},
+	}
+
+	if s.proxies == nil {
+		s.proxies = map[string]*http.Client{}
+	}
+	s.proxies[name] = c
+
+	return c
+}
+
+func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request, targetBooru string, token string) {
+	b, ok := s.Boorus[targetBooru]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Anything after the token is only there for the browser
+	if i := strings.IndexByte(token, '.'); i >= 0 {
+		token = token[:i]
+	}
+
+	target, err := s.proxyTarget(r.Context(), targetBooru, b, token)
+	if errors.Is(err, errBadToken) || errors.Is(err, booru.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		proxyError(w, r, targetBooru, err)
+		return
+	}
+
+	u, err := url.Parse(target.Href)
+	if err == nil {
+		err = checkProxyURL(booru.HostsOf(b), u)
+	}
+	if err != nil {
+		// The reason is only for whoever runs this server, as it would tell
+		// clients where things are
+		log.Printf("refusing to proxy a file for %s: %v", targetBooru, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if v := r.URL.Query().Get("w"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil || width < minResize || width > maxResize {
+			http.Error(w, fmt.Sprintf("w must be between %d and %d", minResize, maxResize), http.StatusBadRequest)
+			return
+		}
+
+		// Anything else, like videos, is sent as is
+		if resizable[target.MIME] {
+			s.resizeHandler(w, r, s.proxyClient(targetBooru, b), targetBooru+"/"+token, target, u, width)
+			return
+		}
+	}
+
+	// The upstream request is cancelled if the client goes away, or if the
+	// upstream stops sending anything for too long
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	idle := time.AfterFunc(proxyIdleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Copy over request headers if they're there
+	for _, k := range proxyReqHeaders {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	res, err := s.proxyClient(targetBooru, b).Do(req)
+	if err != nil {
+		proxyError(w, r, u.Host, err)
+		return
+	}
+	defer res.Body.Close()
+
+	// Copy over some headers if they're there
+	for _, k := range proxyRespHeaders {
+		if v := res.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+		// Tokens always refer to the same file, and boorus don't change
+		// files once they're uploaded
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Del("Expires")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": target.Name}))
+	}
+
+	w.WriteHeader(res.StatusCode)
+
+	if r.Method == "HEAD" { // We don't send a message body for HEAD
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			idle.Reset(proxyIdleTimeout)
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				// The client went away; nothing else to do
+				return
+			}
+		}
+
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("proxy transfer from %s failed: %v", u.Host, err)
+			}
+			return
+		}
+	}
+}
+
+// proxyError reports a failed upstream request to the client, unless the
+// client is the reason it failed.
+func proxyError(w http.ResponseWriter, r *http.Request, host string, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+
+	log.Printf("proxy request to %s failed: %v", host, err)
+
+	var ne net.Error
+	if errors.Is(err, context.Canceled) || (errors.As(err, &ne) && ne.Timeout()) {
+		http.Error(w, "upstream timed out", http.StatusGatewayTimeout)
+		return
+	}
+
+	http.Error(w, "upstream request failed", http.StatusBadGateway)
+}
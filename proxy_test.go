@@ -0,0 +1,185 @@
+package boorumux
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+// proxyBooru is a booru with a single post, whose original file is at href.
+type proxyBooru struct {
+	href   string
+	hosts  []string
+	client *http.Client
+}
+
+func (b *proxyBooru) Page(ctx context.Context, q booru.Query, page int) ([]booru.Post, int, error) {
+	return nil, 0, nil
+}
+
+func (b *proxyBooru) Post(ctx context.Context, id int) (*booru.Post, error) {
+	return &booru.Post{Id: id, Hash: "abc", Origin: b, Original: booru.Image{Href: b.href, MIME: "image/png"}}, nil
+}
+
+func (b *proxyBooru) HTTP() *http.Client {
+	if b.client != nil {
+		return b.client
+	}
+	return &http.Client{}
+}
+func (b *proxyBooru) Hosts() []string { return b.hosts }
+
+// upstream starts a server counting how many requests it gets.
+func upstream(t *testing.T, h http.HandlerFunc) (*httptest.Server, *int32) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+// proxyGet asks s for the original file of the post on b through the proxy,
+// using token if it isn't empty.
+func proxyGet(s *Server, b *proxyBooru, token string) *httptest.ResponseRecorder {
+	if token == "" {
+		p, _ := b.Post(context.Background(), 1)
+		token = strings.TrimPrefix(s.proxyURL(*p, "orig"), "/test/proxy/")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/test/proxy/"+token, nil))
+	return w
+}
+
+func TestProxy(t *testing.T) {
+	up, hits := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	})
+
+	b := &proxyBooru{href: up.URL + "/a.png", hosts: []string{"127.0.0.1"}}
+	s := &Server{Boorus: map[string]booru.API{"test": b}}
+
+	w := proxyGet(s, b, "")
+	if w.Code != http.StatusOK || w.Body.String() != "image" {
+		t.Fatalf("got %d %q, want the file", w.Code, w.Body.String())
+	}
+	if *hits != 1 {
+		t.Errorf("upstream was asked %d times, want 1", *hits)
+	}
+}
+
+func TestProxyBadToken(t *testing.T) {
+	up, hits := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	})
+
+	b := &proxyBooru{href: up.URL + "/a.png", hosts: []string{"127.0.0.1"}}
+	s := &Server{Boorus: map[string]booru.API{"test": b}}
+
+	p, _ := b.Post(context.Background(), 1)
+	good := strings.TrimSuffix(strings.TrimPrefix(s.proxyURL(*p, "orig"), "/test/proxy/"), ".png")
+	sig := good[strings.LastIndexByte(good, '-')+1:]
+
+	other := &Server{Boorus: s.Boorus}
+	foreign := strings.TrimPrefix(other.proxyURL(*p, "orig"), "/test/proxy/")
+
+	for _, token := range []string{
+		"1-orig-" + sig[:len(sig)-2],
+		"1-orig-" + sig[:len(sig)-1] + "0",
+		"1-orig-",
+		"1-orig",
+		"2-orig-" + sig,
+		"1-sample-" + sig,
+		"x-orig-" + sig,
+		foreign,
+	} {
+		if w := proxyGet(s, b, token); w.Code != http.StatusNotFound {
+			t.Errorf("token %q: got %d, want %d", token, w.Code, http.StatusNotFound)
+		}
+	}
+
+	if *hits != 0 {
+		t.Errorf("upstream was asked %d times, want 0", *hits)
+	}
+}
+
+func TestProxyHostNotAllowed(t *testing.T) {
+	b := &proxyBooru{href: "http://files.example.net/a.png", hosts: []string{"example.com", "*.example.org"}}
+	s := &Server{Boorus: map[string]booru.API{"test": b}}
+
+	w := proxyGet(s, b, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if strings.Contains(w.Body.String(), "example") {
+		t.Errorf("response %q names the host", w.Body.String())
+	}
+}
+
+func TestProxyRedirect(t *testing.T) {
+	// Everything goes through an HTTP proxy, which is trusted, so only the
+	// redirect itself can be refused
+	var elsewhere int32
+	up, _ := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Hostname() {
+		case "files.example.com":
+			http.Redirect(w, r, "http://elsewhere.example/secret", http.StatusFound)
+		case "elsewhere.example":
+			atomic.AddInt32(&elsewhere, 1)
+			w.Write([]byte("secret"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	pu, _ := url.Parse(up.URL)
+	b := &proxyBooru{
+		href:   "http://files.example.com/a.png",
+		hosts:  []string{"files.example.com"},
+		client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}},
+	}
+	s := &Server{Boorus: map[string]booru.API{"test": b}}
+
+	w := proxyGet(s, b, "")
+	if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("got %d %q, want the redirect refused", w.Code, w.Body.String())
+	}
+	if elsewhere != 0 {
+		t.Errorf("redirect target was asked %d times, want 0", elsewhere)
+	}
+}
+
+func TestProxyPrivateAddress(t *testing.T) {
+	up, hits := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	})
+	port := up.URL[strings.LastIndexByte(up.URL, ':'):]
+
+	// Only hosts named exactly may be private; these are allowed by a
+	// wildcard, so they must be on the internet
+	for _, href := range []string{
+		"http://localhost" + port + "/a.png",
+		"http://127.0.0.1" + port + "/a.png",
+		"http://10.0.0.1" + port + "/a.png",
+		"http://[::1]" + port + "/a.png",
+	} {
+		b := &proxyBooru{href: href, hosts: []string{"*.localhost", "*.127.0.0.1", "*.10.0.0.1", "*.::1"}}
+		s := &Server{Boorus: map[string]booru.API{"test": b}}
+
+		if w := proxyGet(s, b, ""); w.Code == http.StatusOK {
+			t.Errorf("%s: got %d %q, want the connection refused", href, w.Code, w.Body.String())
+		}
+	}
+
+	if *hits != 0 {
+		t.Errorf("upstream was asked %d times, want 0", *hits)
+	}
+}
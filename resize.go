@@ -0,0 +1,298 @@
+package boorumux
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minResize and maxResize are the limits of the width images can be
+	// resized to.
+	minResize = 16
+	maxResize = 2048
+
+	// maxResizeInput is the largest file that will be resized.
+	maxResizeInput = 32 << 20
+
+	// maxResizePixels is the largest image, in pixels, that will be resized.
+	// It stops small files that decode into huge images from eating all of
+	// our memory.
+	maxResizePixels = 50_000_000
+
+	// defaultResizeQuality is the JPEG quality of resized images if it isn't
+	// set.
+	defaultResizeQuality = 75
+
+	// thumbWidth is the width of a thumbnail in the grid, which is what they
+	// are resized to in data saver mode.
+	thumbWidth = 195
+
+	// dataSaverCookie is the name of the cookie holding the data saver
+	// setting.
+	dataSaverCookie = "datasaver"
+)
+
+// resizable lists the types of images that can be resized.
+var resizable = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// resizeSem limits how many images are resized at once, as it is heavy on
+// the CPU.
+var resizeSem = make(chan struct{}, runtime.NumCPU())
+
+// cache returns the media cache, setting it up if needed.
+func (s *Server) cache() *mediaCache {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.media.max == 0 {
+		s.media.max = s.CacheSize
+		if s.media.max <= 0 {
+			s.media.max = defaultCacheSize
+		}
+	}
+
+	return &s.media
+}
+
+// downscale resizes src to be w pixels wide, keeping its aspect ratio.
+// Every pixel is the average of the pixels it covers in src, which looks good
+// enough for thumbnails and is simple.
+// Transparency is flattened onto white, as JPEG doesn't have any.
+func downscale(src image.Image, w int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	h := sh * w / sw
+	if h < 1 {
+		h = 1
+	}
+
+	flat := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, b.Min, draw.Over)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := flat.Pix[sy*flat.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+3]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					bl += uint32(p[2])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4 : y*dst.Stride+x*4+4]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(bl/n), 0xff
+		}
+	}
+
+	return dst
+}
+
+// decodeImage decodes an image, refusing to do so if it is too large.
+// Callers should hold resizeSem.
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Width*cfg.Height > maxResizePixels {
+		return nil, fmt.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// resize decodes an image and makes it w pixels wide, encoding it as a JPEG.
+// If the image is already small enough, nothing is done and false is
+// returned.
+func resize(data []byte, w, quality int) ([]byte, bool, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if cfg.Width <= w {
+		return nil, false, nil
+	}
+
+	resizeSem <- struct{}{}
+	defer func() { <-resizeSem }()
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, downscale(img, w), &jpeg.Options{Quality: quality}); err != nil {
+		return nil, false, err
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+// resizeHandler serves an image resized to be width pixels wide.
+// Results are kept in the media cache, and since tokens always refer to the
+// same file, they never need to be checked again.
+func (s *Server) resizeHandler(w http.ResponseWriter, r *http.Request, c *http.Client, key string, target proxyFile, u *url.URL, width int) {
+	key = key + "@" + strconv.Itoa(width)
+	etag := strconv.Quote(strings.ReplaceAll(key, "/", "-"))
+
+	name := strings.TrimSuffix(target.Name, path.Ext(target.Name))
+	serve := func(e mediaEntry) {
+		if e.mime == "image/jpeg" {
+			name += ".jpg"
+		} else {
+			name = target.Name
+		}
+
+		w.Header().Set("Content-Type", e.mime)
+		w.Header().Set("Etag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(e.data))
+	}
+
+	cache := s.cache()
+	if e, ok := cache.get(key); ok {
+		serve(e)
+		return
+	} else if r.Header.Get("If-None-Match") == etag {
+		// It's only ever going to be the same thing
+		w.Header().Set("Etag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*proxyIdleTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		proxyError(w, r, u.Host, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		http.Error(w, http.StatusText(res.StatusCode), res.StatusCode)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResizeInput+1))
+	if err != nil {
+		proxyError(w, r, u.Host, err)
+		return
+	} else if len(data) > maxResizeInput {
+		http.Error(w, "file is too large to resize", http.StatusBadGateway)
+		return
+	}
+
+	quality := s.ResizeQuality
+	if quality <= 0 || quality > 100 {
+		quality = defaultResizeQuality
+	}
+
+	e := mediaEntry{mime: res.Header.Get("Content-Type"), data: data}
+	if out, ok, err := resize(data, width, quality); err != nil {
+		// Send it as it is; it's better than nothing
+		log.Printf("failed resizing %s: %v", u.Host+u.Path, err)
+	} else if ok {
+		e = mediaEntry{mime: "image/jpeg", data: out}
+	}
+
+	cache.put(key, e.mime, e.data)
+	serve(e)
+}
+
+// dataSaver reports whether the client has data saver mode on.
+func dataSaver(r *http.Request) bool {
+	c, err := r.Cookie(dataSaverCookie)
+	return err == nil && c.Value == "1"
+}
+
+// dataSaverHandler toggles data saver mode, and sends the client back to
+// where they came from.
+// Only POST is accepted, so following a link can't change it.
+func (s *Server) dataSaverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := &http.Cookie{
+		Name:     dataSaverCookie,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   60 * 60 * 24 * 365,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if dataSaver(r) {
+		c.Value = ""
+		c.MaxAge = -1
+	}
+
+	http.SetCookie(w, c)
+
+	// Only the path is kept so this can't send anybody elsewhere; paths
+	// starting with "//" or "/\" are taken by browsers as another host
+	back := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && localPath(ref.Path) {
+		back = ref.RequestURI()
+	}
+
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// localPath reports whether p is a path on this server, which is safe to
+// redirect to.
+func localPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
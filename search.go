@@ -0,0 +1,219 @@
+package boorumux
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
+)
+
+const (
+	maxLimit = 200
+
+	// defaultSidebarTags and maxSidebarTags are the default and highest number
+	// of tags shown in the sidebar of a page.
+	defaultSidebarTags = 25
+	maxSidebarTags     = 200
+)
+
+// searchRatings maps the values of the rating parameter to actual ratings.
+var searchRatings = map[string]booru.Rating{
+	"general":      booru.General,
+	"sensitive":    booru.Sensitive,
+	"questionable": booru.Questionable,
+	"explicit":     booru.Explicit,
+}
+
+// searchOrders are the orders offered in the search options, mapped to a
+// human readable name.
+var searchOrders = map[string]string{
+	"id_asc":    "Oldest",
+	"score":     "Score",
+	"favorites": "Favorites",
+	"updated":   "Updated",
+	"random":    "Random",
+}
+
+// tagSorts are the orders tags in the sidebar can be sorted in, mapped to a
+// human readable name.
+// The empty one, the default, sorts by how many posts on the page have them.
+var tagSorts = map[string]string{
+	"":      "On this page",
+	"total": "Total posts",
+}
+
+// search holds the parameters of a search, as they appear in the query
+// string.
+// They are kept as is so they can be carried across links.
+type search struct {
+	Q       string
+	Mux     []string
+	Limit   string
+	Order   string
+	Ratings []string
+	Score   string
+	Before  string
+	After   string
+
+	// TagLimit and TagSort are the number of tags shown in the sidebar, and
+	// how they are sorted.
+	TagLimit string
+	TagSort  string
+
+	// BeforeID and AfterID are cursors, which are not carried across links
+	// as they are only relevant to one page.
+	BeforeID string
+	AfterID  string
+}
+
+// parseSearch reads search parameters from a query string, and converts them
+// into a booru.Query.
+func parseSearch(v url.Values) (search, booru.Query, error) {
+	s := search{
+		Q:       v.Get("q"),
+		Mux:     v["b"],
+		Limit:   v.Get("limit"),
+		Order:   v.Get("order"),
+		Ratings: v["rating"],
+		Score:   v.Get("score"),
+		Before:  v.Get("before"),
+		After:   v.Get("after"),
+
+		TagLimit: v.Get("tag_limit"),
+		TagSort:  v.Get("tag_sort"),
+
+		BeforeID: v.Get("before_id"),
+		AfterID:  v.Get("after_id"),
+	}
+
+	q := booru.Query{Order: s.Order}
+	if s.Q != "" {
+		q.Tags = strings.Split(s.Q, " ")
+	}
+
+	if s.Limit != "" {
+		n, err := strconv.Atoi(s.Limit)
+		if err != nil || n < 1 || n > maxLimit {
+			return s, q, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		q.Limit = n
+	}
+
+	if s.TagLimit != "" {
+		n, err := strconv.Atoi(s.TagLimit)
+		if err != nil || n < 1 || n > maxSidebarTags {
+			return s, q, fmt.Errorf("tag_limit must be between 1 and %d", maxSidebarTags)
+		}
+	}
+
+	if _, ok := tagSorts[s.TagSort]; !ok {
+		return s, q, fmt.Errorf("unknown tag sort \"%s\"", s.TagSort)
+	}
+
+	for _, r := range s.Ratings {
+		rr, ok := searchRatings[r]
+		if !ok {
+			return s, q, fmt.Errorf("unknown rating \"%s\"", r)
+		}
+		q.Ratings = append(q.Ratings, rr)
+	}
+
+	if s.Score != "" {
+		n, err := strconv.Atoi(s.Score)
+		if err != nil {
+			return s, q, fmt.Errorf("invalid score: %w", err)
+		}
+		q.MinScore = &n
+	}
+
+	var err error
+	if s.Before != "" {
+		if q.Before, err = time.Parse("2006-01-02", s.Before); err != nil {
+			return s, q, fmt.Errorf("invalid date: %w", err)
+		}
+	}
+
+	if s.After != "" {
+		if q.After, err = time.Parse("2006-01-02", s.After); err != nil {
+			return s, q, fmt.Errorf("invalid date: %w", err)
+		}
+	}
+
+	if s.BeforeID != "" {
+		if q.BeforeID, err = strconv.Atoi(s.BeforeID); err != nil {
+			return s, q, fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+
+	if s.AfterID != "" {
+		if q.AfterID, err = strconv.Atoi(s.AfterID); err != nil {
+			return s, q, fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+
+	return s, q, nil
+}
+
+// useCursor determines if a booru should be paged through using cursors
+// instead of page numbers.
+// Cursors only work when posts are sorted by their ID, which is the default.
+func useCursor(b booru.API, q booru.Query) bool {
+	if !booru.CapabilitiesOf(b).Has(booru.CapCursor) || q.Order != "" {
+		return false
+	}
+
+	for _, t := range booru.ParseTags(q.Tags) {
+		if t.Kind == booru.TermOrder {
+			return false
+		}
+	}
+
+	return true
+}
+
+// values converts the search back into query string values.
+// Empty parameters are left out.
+func (s search) values() url.Values {
+	v := url.Values{}
+
+	set := func(k, val string) {
+		if val != "" {
+			v.Set(k, val)
+		}
+	}
+
+	set("q", s.Q)
+	set("limit", s.Limit)
+	set("order", s.Order)
+	set("score", s.Score)
+	set("before", s.Before)
+	set("after", s.After)
+	set("tag_limit", s.TagLimit)
+	set("tag_sort", s.TagSort)
+
+	if len(s.Mux) > 0 {
+		v["b"] = s.Mux
+	}
+
+	if len(s.Ratings) > 0 {
+		v["rating"] = s.Ratings
+	}
+
+	return v
+}
+
+// tagLimit returns the number of tags to show in the sidebar.
+func (s search) tagLimit() int {
+	if n, err := strconv.Atoi(s.TagLimit); err == nil && n > 0 && n <= maxSidebarTags {
+		return n
+	}
+	return defaultSidebarTags
+}
+
+// HasRating reports if a rating was selected, for use in templates.
+func (s search) HasRating(r string) bool {
+	return has(r, s.Ratings)
+}
@@ -2,12 +2,9 @@ package boorumux
 
 import (
 	"html/template"
-	"io"
-	"log"
 	"net/http"
 	"regexp"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/KushBlazingJudah/boorumux/booru"
@@ -22,30 +19,9 @@ const (
 	reqProxy
 )
 
-const (
-	maxSidebarTags = 25
-)
-
 var indexRegexp = regexp.MustCompile(`^/([0-9a-z+]+)/?$`)
-var proxyRegexp = regexp.MustCompile(`^/([0-9a-z+]+)/proxy/[^/]*`)
-
-// proxyReqHeaders is a list of headers that are sent with a proxy request to a
-// booru.
-var proxyReqHeaders = []string{
-	"Range",
-}
-
-// proxyRespHeaders is a list of headers copied from the response from the
-// server for a proxy request.
-var proxyRespHeaders = []string{
-	"Content-Type",
-	"Content-Length",
-	"Accept-Ranges",
-	"Last-Modified",
-	"Etag",
-	"Expires",
-	"Cache-Control",
-}
+var proxyRegexp = regexp.MustCompile(`^/([0-9a-z+]+)/proxy/([^/]+)$`)
+var autocompleteRegexp = regexp.MustCompile(`^/([0-9a-z+]+)/autocomplete$`)
 
 // Server holds the main configuration for Boorumux and doubles as a
 // http.Handler.
@@ -62,19 +38,94 @@ type Server struct {
 	Boorus map[string]booru.API
 
 	// Blacklist is a list of blacklisted tags.
-	// Posts containing these tags will not be shown in the page view, however
-	// if explicitly requested they will be presented.
+	// Posts containing these tags will not be shown in the page view; if
+	// explicitly requested, they are handled according to PostBlacklist.
 	Blacklist []filter.Filter
 
-	boorus []string
+	// Blacklists holds extra blacklists for specific boorus, keyed by their
+	// name in Boorus.
+	// They apply to posts from that booru, including when they're shown
+	// through a mux, and to everything shown through a mux of that name.
+	Blacklists map[string]SourceBlacklist
+
+	// Tags normalises the tags of every post before they are filtered or
+	// shown, so the same concept has the same name across boorus.
+	// It may be nil.
+	Tags *booru.TagMap
+
+	// Highlight is a list of filters for posts that should stand out, such
+	// as those from watched artists.
+	Highlight []filter.Filter
+
+	// HighlightFirst moves highlighted posts to the top of the page.
+	HighlightFirst bool
+
+	// Secret is the key used to sign links to proxied media.
+	// If empty, a random one is generated, which means links stop working
+	// when the server restarts.
+	Secret []byte
+
+	// ResizeQuality is the JPEG quality of resized images, from 1 to 100.
+	// If zero, a default is used.
+	ResizeQuality int
+
+	// CacheSize is how much memory, in bytes, is used to keep resized images
+	// around.
+	// If zero, a default is used.
+	CacheSize int64
+
+	// PostBlacklist determines what happens when a blacklisted post is viewed
+	// directly, such as through a shared link.
+	PostBlacklist BlacklistMode
+
+	boorus     []string
+	blacklists map[string]*filter.Set
+	highlight  *filter.Set
+	proxies    map[string]*http.Client
+	targets    targetCache
+	media      mediaCache
+
+	placeholders chan placeholderJob
+	pending      map[string]struct{}
 
 	sync.Mutex
 }
 
+// BlacklistMode determines how the blacklist is enforced when viewing a post.
+type BlacklistMode int
+
+const (
+	// BlacklistWarn shows a warning naming the filter that matched, which can
+	// be clicked through.
+	BlacklistWarn BlacklistMode = iota
+
+	// BlacklistOff shows blacklisted posts as if they weren't.
+	BlacklistOff
+
+	// BlacklistBlock refuses to show blacklisted posts at all.
+	BlacklistBlock
+)
+
+// SourceBlacklist is a blacklist that applies to a specific booru.
+type SourceBlacklist struct {
+	Filters []filter.Filter
+
+	// Override makes this blacklist replace the global one, instead of
+	// adding to it.
+	Override bool
+}
+
 // ServeHTTP serves a requested page.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", serverHeader)
 
+	ep := r.URL.EscapedPath()
+	if ep == "/datasaver" {
+		// This changes settings, so it has its own rules
+		s.dataSaverHandler(w, r)
+		return
+	}
+
 	if r.Method != "GET" && r.Method != "HEAD" {
 		// We only support GET and HEAD
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -91,7 +142,6 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.Unlock()
 	}
 
-	ep := r.URL.EscapedPath()
 	if ep == "/favicon.ico" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -114,7 +164,6 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	targetBooru := ""
 	action := reqPage
 	v := 0
-	var tags []string
 	var err error
 
 	// Check if it matches the index regexp
@@ -126,7 +175,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		matches = proxyRegexp.FindStringSubmatch(ep)
 		if len(matches) > 0 {
 			// Yes it does!
-			s.proxyHandler(w, r, matches[1], r.URL.Query().Get("proxy"))
+			s.proxyHandler(w, r, matches[1], matches[2])
+			return
+		}
+
+		matches = autocompleteRegexp.FindStringSubmatch(ep)
+		if len(matches) > 0 {
+			s.autocompleteHandler(w, r, matches[1])
 			return
 		}
 
@@ -153,65 +208,17 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		action = reqPost
 	}
 
-	// Parse tags
-	if t := r.URL.Query().Get("q"); t != "" {
-		tags = strings.Split(t, " ")
+	// Parse the search
+	sr, q, err := parseSearch(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	switch action {
 	case reqPage:
-		s.pageHandler(w, r, targetBooru, v, tags)
+		s.pageHandler(w, r, targetBooru, v, sr, q)
 	case reqPost:
-		s.postHandler(w, r, targetBooru, v)
-	}
-}
-
-func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request, targetBooru string, target string) {
-	defer func() {
-		// XXX: There's this really annoying bug and I'm not sure if it's our
-		// fault or Go's, but essentially under some circumstances io.Copy will
-		// panic with a slice out of bounds error, something along those lines.
-		// I forget.
-		//
-		// Point is, I don't know what actually causes the problem.
-		// I suspect it is a race condition.
-		// If you are a brave soul, remove this deferred function and trigger
-		// it somehow, because I also don't know what triggers it.
-		if v := recover(); v != nil {
-			log.Printf("proxyHandler panic: %v", v)
-		}
-	}()
-
-	// TODO: Trusted domains
-	req, err := http.NewRequest(r.Method, target, nil)
-	if err != nil {
-		panic(err)
-	}
-
-	// Copy over request headers if they're there
-	for _, k := range proxyReqHeaders {
-		if v := r.Header.Get(k); v != "" {
-			req.Header.Set(k, v)
-		}
-	}
-
-	res, err := s.Boorus[targetBooru].HTTP().Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer res.Body.Close()
-
-	// Copy over some headers if they're there
-	for _, k := range proxyRespHeaders {
-		if v := res.Header.Get(k); v != "" {
-			w.Header().Set(k, v)
-		}
-	}
-
-	if r.Method != "HEAD" { // We don't send a message body for HEAD
-		// This is where the aforementioned bug occurs.
-		if _, err := io.Copy(w, res.Body); err != nil {
-			panic(err)
-		}
+		s.postHandler(w, r, targetBooru, v, sr)
 	}
 }
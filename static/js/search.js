@@ -7,3 +7,113 @@ function addTag(name) {
 function delTag(name) {
 	document.getElementById("q").value = document.getElementById("q").value.split(" ").filter((e)=>e!=name).join(" ")
 }
+
+// Autocompletion of tags in the search box
+let search = document.getElementById("search")
+if (search && (search.dataset.caps || "").split(" ").includes("autocomplete")) {
+	let q = document.getElementById("q")
+	let list = document.createElement("ul")
+	list.id = "suggestions"
+	search.appendChild(list)
+
+	let timer = null
+	let seq = 0
+	let selected = -1
+
+	// Finds the word being typed, along with any "-" or "~" in front of it
+	let current = () => {
+		let start = q.value.lastIndexOf(" ", q.selectionStart - 1) + 1
+		let end = q.value.indexOf(" ", start)
+		if (end < 0) end = q.value.length
+
+		let word = q.value.slice(start, end)
+		let sign = word.match(/^[-~]*/)[0]
+		return {start: start, end: end, sign: sign, word: word.slice(sign.length)}
+	}
+
+	let hide = () => {
+		list.replaceChildren()
+		list.style.display = "none"
+		selected = -1
+	}
+
+	let select = (i) => {
+		let items = list.children
+		if (items.length == 0) return
+
+		selected = (i + items.length) % items.length
+		for (let j = 0; j < items.length; j++)
+			items[j].classList.toggle("selected", j == selected)
+	}
+
+	let complete = (name) => {
+		let c = current()
+		let before = q.value.slice(0, c.start) + c.sign + name + " "
+		q.value = before + q.value.slice(c.end).trimStart()
+		q.setSelectionRange(before.length, before.length)
+		hide()
+		q.focus()
+	}
+
+	let show = (tags) => {
+		list.replaceChildren()
+		for (let t of tags) {
+			let li = document.createElement("li")
+			li.className = "tag " + t.category
+			li.dataset.name = t.name
+
+			let name = document.createElement("span")
+			name.className = "tagname"
+			name.textContent = t.name.replaceAll("_", " ")
+
+			let count = document.createElement("span")
+			count.className = "count"
+			count.textContent = t.count
+
+			li.append(name, count)
+			li.onmousedown = (e) => { e.preventDefault(); complete(t.name) }
+			list.appendChild(li)
+		}
+
+		selected = -1
+		list.style.display = tags.length > 0 ? "" : "none"
+	}
+
+	let suggest = () => {
+		let c = current()
+		if (c.word == "" || c.word.includes(":")) { hide(); return }
+
+		let params = new URLSearchParams()
+		params.set("q", c.word)
+		for (let b of search.querySelectorAll("input[name=b]")) params.append("b", b.value)
+
+		let n = ++seq
+		fetch(search.getAttribute("action") + "/autocomplete?" + params)
+			.then((r) => r.ok ? r.json() : [])
+			.then((tags) => { if (n == seq) show(tags) })
+			.catch(() => {})
+	}
+
+	q.setAttribute("autocomplete", "off")
+	hide()
+
+	q.oninput = () => {
+		clearTimeout(timer)
+		timer = setTimeout(suggest, 150)
+	}
+
+	q.onkeydown = (e) => {
+		if (list.children.length == 0) return
+
+		if (e.key == "ArrowDown") select(selected + 1)
+		else if (e.key == "ArrowUp") select(selected - 1)
+		else if (e.key == "Escape") hide()
+		else if ((e.key == "Enter" || e.key == "Tab") && selected >= 0)
+			complete(list.children[selected].dataset.name)
+		else return
+
+		e.preventDefault()
+	}
+
+	q.onblur = hide
+}
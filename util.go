@@ -8,6 +8,8 @@ import (
 	"sort"
 	"strings"
 	"sync"
+
+	"github.com/KushBlazingJudah/boorumux/booru"
 )
 
 // counter can count items according to how often they appear.
@@ -55,8 +57,14 @@ func humanSize(b int) string {
 	return fmt.Sprintf("%.2f %s", f, r)
 }
 
-// mostCommon returns the most common items in a list.
-func mostCommon(list []string) []string {
+// tally is an item and how many times it was counted.
+type tally struct {
+	Item  string
+	Count int
+}
+
+// mostCommon counts the items in a list, returning them most common first.
+func mostCommon(list []string) []tally {
 	c := counterPool.Get().(counter)
 
 	// defers are LIFO; this resets it first and then checks it into the pool
@@ -67,51 +75,148 @@ func mostCommon(list []string) []string {
 		c.count(v)
 	}
 
-	o := make([]string, 0, len(c))
-	for k := range c {
-		o = append(o, k.(string))
+	o := make([]tally, 0, len(c))
+	for k, n := range c {
+		o = append(o, tally{k.(string), n})
 	}
 
-	sort.Strings(o)
-
 	sort.Slice(o, func(i, j int) bool {
-		return c[o[i]] < c[o[j]]
+		if o[i].Count != o[j].Count {
+			return o[i].Count > o[j].Count
+		}
+		return o[i].Item < o[j].Item
 	})
 
-	for i, j := 0, len(o)-1; i < j; i, j = i+1, j-1 {
-		o[i], o[j] = o[j], o[i]
-	}
-
 	return o
 }
 
-func buildPageBlock(base string, hasAttrs bool, current int) template.HTML {
-	// TODO: This function really sucks; list out a couple pages, in a form
-	// similar to this: 1 2 ... 5 [6] 7 ... 12
+// buildPageBlock creates a list of links to pages, in a form similar to this:
+// « 1 2 ... 5 [6] 7 ... 12 »
+//
+// Pages are counted from zero, but shown counting from one.
+// last is the last page, or -1 if it is unknown, in which case only the pages
+// up to the current one are known to exist.
+// If more isn't 0, the link to the next page carries on from the post with
+// that ID using a cursor instead, for going past the last page.
+func buildPageBlock(base string, current, last, more int) template.HTML {
+	const around = 2
 
 	c := "&"
-	if !hasAttrs {
+	if !strings.Contains(base, "?") {
 		c = "?"
 	}
 
+	link := func(sb *strings.Builder, p int, label string) {
+		if p == 0 {
+			fmt.Fprintf(sb, ` <a href="%s">%s</a>`, base, label)
+		} else {
+			fmt.Fprintf(sb, ` <a href="%s%spage=%d">%s</a>`, base, c, p, label)
+		}
+	}
+
+	end := last
+	if end < 0 || end < current {
+		end = current
+	}
+
 	sb := strings.Builder{}
 	sb.WriteString(`<div id="pages">`)
-	if current != 0 {
-		fmt.Fprintf(&sb, ` <a href="%s">0</a>`, base)
-		if current-1 > 0 {
-			fmt.Fprintf(&sb, ` ... <a href="%s%spage=%d">%d</a> `, base, c, current-1, current-1)
+	if current > 0 {
+		link(&sb, current-1, "&laquo;")
+	}
+
+	prev := -1
+	for p := 0; p <= end; p++ {
+		if p != 0 && p != end && (p < current-around || p > current+around) {
+			continue
+		}
+
+		if prev >= 0 && p-prev > 1 {
+			sb.WriteString(" ...")
 		}
-		fmt.Fprintf(&sb, ` <b>%d</b> `, current)
+
+		if p == current {
+			fmt.Fprintf(&sb, ` <b>%d</b>`, p+1)
+		} else {
+			link(&sb, p, fmt.Sprint(p+1))
+		}
+		prev = p
+	}
+
+	if more != 0 {
+		fmt.Fprintf(&sb, ` <a href="%s%sbefore_id=%d">&raquo;</a>`, base, c, more)
+	} else if last < 0 || current < last {
+		link(&sb, current+1, "&raquo;")
 	}
-	fmt.Fprintf(&sb, ` <a href="%s%spage=%d">next</a>`, base, c, current+1)
 	sb.WriteString(`</div>`)
 	return template.HTML(sb.String())
 }
 
+// buildCursorBlock is like buildPageBlock, but for boorus that are paged
+// through using cursors.
+// first links back to the first page, prev is the highest ID on the page and
+// next is the lowest, either of which may be 0 to hide the link.
+// total is the number of results, or -1 if it is unknown.
+func buildCursorBlock(base string, first bool, prev, next, total int) template.HTML {
+	c := "&"
+	if !strings.Contains(base, "?") {
+		c = "?"
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(`<div id="pages">`)
+	if first {
+		fmt.Fprintf(&sb, ` <a href="%s">first</a>`, base)
+	}
+	if prev != 0 {
+		fmt.Fprintf(&sb, ` <a href="%s%safter_id=%d">prev</a>`, base, c, prev)
+	}
+	if next != 0 {
+		fmt.Fprintf(&sb, ` <a href="%s%sbefore_id=%d">next</a>`, base, c, next)
+	}
+	if total >= 0 {
+		fmt.Fprintf(&sb, ` <span class="total">results: %d</span>`, total)
+	}
+	sb.WriteString(`</div>`)
+	return template.HTML(sb.String())
+}
+
+// countRule adds one to the count of a rule, adding it if it isn't there.
+func countRule(rs []hiddenRule, rule string) []hiddenRule {
+	for i := range rs {
+		if rs[i].Rule == rule {
+			rs[i].Count++
+			return rs
+		}
+	}
+
+	return append(rs, hiddenRule{Rule: rule, Count: 1})
+}
+
+// toggleParam returns a link to u with a boolean query parameter toggled.
+func toggleParam(u *url.URL, key string) string {
+	v := u.Query()
+	if v.Get(key) != "" {
+		v.Del(key)
+	} else {
+		v.Set(key, "1")
+	}
+
+	nu := *u
+	nu.RawQuery = v.Encode()
+	return nu.RequestURI()
+}
+
 func prettyUrl(u string) string {
 	return schemaRegexp.ReplaceAllString(u, "")
 }
 
+// can reports whether a booru supports a capability, referenced by its short
+// name.
+func can(c booru.Capability, name string) bool {
+	return has(name, c.Names())
+}
+
 func has[T comparable](needle T, haystack []T) bool {
 	for _, v := range haystack {
 		if v == needle {
@@ -121,27 +226,19 @@ func has[T comparable](needle T, haystack []T) bool {
 	return false
 }
 
-func mkUrl(cur string, q string, mux []string) string {
-	if mux == nil && q == "" {
-		return "/" + cur
-	} else if mux == nil {
-		return fmt.Sprintf("/%s?q=%s", cur, url.QueryEscape(q))
+// mkUrl creates a link to a booru that searches for q, keeping the rest of
+// the options of a search.
+// The list of boorus in a mux is only kept when linking to the mux.
+func mkUrl(cur string, q string, s search) string {
+	s.Q = q
+	if cur != "mux" {
+		s.Mux = nil
 	}
 
-	b := strings.Builder{}
-	b.WriteRune('/')
-	b.WriteString(cur)
-	b.WriteRune('?')
-	for i, m := range mux {
-		if i > 0 {
-			b.WriteRune('&')
-		}
-		b.WriteString("b=")
-		b.WriteString(url.QueryEscape(m))
-	}
-	if q != "" {
-		b.WriteString("&q=")
-		b.WriteString(url.QueryEscape(q))
+	v := s.values()
+	if len(v) == 0 {
+		return "/" + cur
 	}
-	return b.String()
+
+	return "/" + cur + "?" + v.Encode()
 }